@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcSender отправляет пакеты метрик вызовом Updates. Подпись и адрес агента
+// передаются в метаданных, как заголовки HashSHA256 и X-Real-IP у httpSender.
+type grpcSender struct {
+	client   pb.MetricsClient
+	password string
+	realIP   string
+}
+
+// postBatch отправляет пакет. Если сервер отклонил отдельные метрики, они отбрасываются,
+// а остальные отправляются повторно.
+func (s *grpcSender) postBatch(ctx context.Context, batch []models.Metrics) error {
+	req := &pb.UpdatesRequest{Metrics: pb.FromModels(batch)}
+	md := metadata.MD{}
+	if s.password != "" {
+		signature, err := pb.Sign(req, s.password)
+		if err != nil {
+			return err
+		}
+		md.Set(pb.SignHeader, signature)
+	}
+	if s.realIP != "" {
+		md.Set(pb.RealIPHeader, s.realIP)
+	}
+	if id := logger.RequestID(ctx); id != "" {
+		md.Set(logger.RequestIDHeader, id)
+	}
+
+	var header metadata.MD
+	resp, err := s.client.Updates(metadata.NewOutgoingContext(ctx, md), req, grpc.Header(&header))
+	if st, ok := status.FromError(err); ok && st.Code() == codes.InvalidArgument {
+		for _, d := range st.Details() {
+			result, ok := d.(*pb.UpdatesResponse)
+			if !ok || len(result.GetErrors()) == 0 {
+				continue
+			}
+			rest := withoutRejected(batch, pb.ToBatchErrors(result.GetErrors()), logger.FromContext(ctx))
+			if len(rest) > 0 && len(rest) < len(batch) {
+				return s.postBatch(ctx, rest)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.password != "" {
+		values := header.Get(pb.SignHeader)
+		if len(values) == 0 || !pb.ValidSign(resp, s.password, values[0]) {
+			return errors.New("grpc response has invalid signature")
+		}
+	}
+	return nil
+}
@@ -1,133 +1,172 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/hashicorp/go-retryablehttp"
+	"github.com/lionslon/go-yapmetrics/internal/collector"
 	"github.com/lionslon/go-yapmetrics/internal/config"
-	"github.com/lionslon/go-yapmetrics/internal/middlewares"
-	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/pb"
 	"go.uber.org/zap"
-	"math/rand"
-	"runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var valuesGauge = map[string]float64{}
-var pollCount uint64
+// shutdownTimeout сколько ждать отправки последнего отчёта при остановке агента.
+const shutdownTimeout = 10 * time.Second
 
 func main() {
 
 	cfg := config.NewClient()
 
-	pollTicker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
-	defer pollTicker.Stop()
-	reportTicker := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
-	defer reportTicker.Stop()
-
-	for {
-		select {
-		case <-pollTicker.C:
-			getMetrics()
-		case <-reportTicker.C:
-			postQueries(cfg)
-		}
+	l, err := logger.New(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func getMetrics() {
-	var rtm runtime.MemStats
+	defer l.Sync()
 
-	pollCount += 1
-	runtime.ReadMemStats(&rtm)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	valuesGauge["Alloc"] = float64(rtm.Alloc)
-	valuesGauge["BuckHashSys"] = float64(rtm.BuckHashSys)
-	valuesGauge["Frees"] = float64(rtm.Frees)
-	valuesGauge["GCCPUFraction"] = float64(rtm.GCCPUFraction)
-	valuesGauge["HeapAlloc"] = float64(rtm.HeapAlloc)
-	valuesGauge["HeapIdle"] = float64(rtm.HeapIdle)
-	valuesGauge["HeapInuse"] = float64(rtm.HeapInuse)
-	valuesGauge["HeapObjects"] = float64(rtm.HeapObjects)
-	valuesGauge["HeapReleased"] = float64(rtm.HeapReleased)
-	valuesGauge["HeapSys"] = float64(rtm.HeapSys)
-	valuesGauge["LastGC"] = float64(rtm.LastGC)
-	valuesGauge["Lookups"] = float64(rtm.Lookups)
-	valuesGauge["MCacheInuse"] = float64(rtm.MCacheInuse)
-	valuesGauge["MCacheSys"] = float64(rtm.MCacheSys)
-	valuesGauge["MSpanInuse"] = float64(rtm.MSpanInuse)
-	valuesGauge["MSpanSys"] = float64(rtm.MSpanSys)
-	valuesGauge["Mallocs"] = float64(rtm.Mallocs)
-	valuesGauge["NextGC"] = float64(rtm.NextGC)
-	valuesGauge["NumForcedGC"] = float64(rtm.NumForcedGC)
-	valuesGauge["NumGC"] = float64(rtm.NumGC)
-	valuesGauge["OtherSys"] = float64(rtm.OtherSys)
-	valuesGauge["PauseTotalNs"] = float64(rtm.PauseTotalNs)
-	valuesGauge["StackInuse"] = float64(rtm.StackInuse)
-	valuesGauge["StackSys"] = float64(rtm.StackSys)
-	valuesGauge["Sys"] = float64(rtm.Sys)
-	valuesGauge["TotalAlloc"] = float64(rtm.TotalAlloc)
-}
-
-func postQueries(cfg *config.ClientConfig) {
-	url := fmt.Sprintf("http://%s/update/", cfg.Addr)
-	client := retryablehttp.NewClient()
-	client.RetryMax = 3
-	client.RetryWaitMin = time.Second * 1
-	client.RetryWaitMax = time.Second * 5
-
-	for k, v := range valuesGauge {
-		postJSON(client, url, models.Metrics{ID: k, MType: "gauge", Value: &v}, cfg.SignPass)
+	if err := run(logger.WithContext(ctx, l), cfg); err != nil {
+		l.Fatal("agent stopped", zap.Error(err))
 	}
-	pc := int64(pollCount)
-	postJSON(client, url, models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc}, cfg.SignPass)
-	r := rand.Float64()
-	postJSON(client, url, models.Metrics{ID: "RandomValue", MType: "gauge", Value: &r}, cfg.SignPass)
-	pollCount = 0
 }
 
-func postJSON(c *retryablehttp.Client, url string, m models.Metrics, password string) {
-	js, err := json.Marshal(m)
-	if err != nil {
-		zap.S().Error(err)
-	}
-
-	gz, err := compress(js)
-	if err != nil {
-		zap.S().Error(err)
+// newSender создаёт отправителя для выбранного транспорта. Возвращаемая функция
+// закрывает соединение и вызывается после остановки воркеров.
+func newSender(cfg *config.ClientConfig, log *zap.Logger) (batchSender, func(), error) {
+	switch cfg.Transport {
+	case "grpc":
+		if cfg.CryptoKey != "" {
+			return nil, nil, errors.New("-crypto-key is not supported with -transport=grpc")
+		}
+		if cfg.GRPCAddr == "" {
+			return nil, nil, errors.New("-g is required with -transport=grpc")
+		}
+		conn, err := grpc.Dial(cfg.GRPCAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, nil, err
+		}
+		s := &grpcSender{client: pb.NewMetricsClient(conn), password: cfg.SignPass, realIP: detectRealIP(cfg.GRPCAddr, log)}
+		return s, func() { conn.Close() }, nil
+	case "http", "":
+		s := &httpSender{
+			client:   newClient(),
+			url:      fmt.Sprintf("http://%s/updates/", cfg.Addr),
+			password: cfg.SignPass,
+			realIP:   detectRealIP(cfg.Addr, log),
+		}
+		if cfg.CryptoKey != "" {
+			pub, err := encryption.LoadPublicKey(cfg.CryptoKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			s.publicKey = pub
+		}
+		return s, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown transport %q, can only be 'http' or 'grpc'", cfg.Transport)
 	}
+}
 
-	req, err := retryablehttp.NewRequest("POST", url, gz)
+// run собирает и отправляет метрики, пока не отменён ctx. После отмены опрос останавливается,
+// собранные метрики отправляются последним отчётом; на постановку его в очередь и ожидание
+// воркеров вместе уходит не больше shutdownTimeout.
+// Сообщения пишутся в логгер из ctx.
+func run(ctx context.Context, cfg *config.ClientConfig) error {
+	log := logger.FromContext(ctx)
+	s, closeSender, err := newSender(cfg, log)
 	if err != nil {
-		zap.S().Error(err)
+		return err
 	}
-
-	singPassword := []byte(password)
-	if singPassword != nil {
-		req.Header.Add("HashSHA256", middlewares.GetSign(js, singPassword))
+	defer closeSender()
+	ms := newMetricsState(agentLabels(cfg.Instance, log))
+
+	// Запросы отменяются отдельно от ctx, чтобы последний отчёт успел уйти после сигнала.
+	sendCtx, cancelSend := context.WithCancel(logger.WithContext(context.Background(), log))
+	defer cancelSend()
+
+	jobs := make(chan job, cfg.RateLimit)
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.RateLimit; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(sendCtx, s, ms, jobs)
+		}()
 	}
 
-	req.Header.Add("content-type", "application/json")
-	req.Header.Add("content-encoding", "gzip")
-	resp, err := c.Do(req)
-	if err != nil {
-		zap.S().Error(err)
-	}
-	defer resp.Body.Close()
-}
+	go func() {
+		pollTicker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
+		defer pollTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pollTicker.C:
+				getMetrics(ms)
+			}
+		}
+	}()
+
+	sys := collector.NewSystem(collector.Config{
+		ProcPath: cfg.ProcPath,
+		Memory:   cfg.CollectMemory,
+		CPU:      cfg.CollectCPU,
+		Disk:     cfg.CollectDisk,
+		Net:      cfg.CollectNet,
+		Load:     cfg.CollectLoad,
+	})
+	go func() {
+		pollTicker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
+		defer pollTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-pollTicker.C:
+				getSystemMetrics(sys, ms, log)
+			}
+		}
+	}()
 
-func compress(b []byte) ([]byte, error) {
-	var bf bytes.Buffer
-	gz, err := gzip.NewWriterLevel(&bf, gzip.BestSpeed)
-	if err != nil {
-		return nil, err
-	}
-	_, err = gz.Write(b)
-	if err != nil {
-		return nil, err
+	reportTicker := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
+	defer reportTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("sending final report")
+			// Таймер запускается до последнего отчёта: при заполненной очереди report ждёт воркеров,
+			// которые могут повторять запросы к недоступному серверу.
+			shutdown, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancelShutdown()
+			report(ms, jobs, cfg.BatchSize, shutdown.Done(), log)
+			close(jobs)
+
+			done := make(chan struct{})
+			go func() {
+				workers.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-shutdown.Done():
+				log.Warn("final report timed out")
+				cancelSend()
+				<-done
+			}
+			return nil
+		case <-reportTicker.C:
+			report(ms, jobs, cfg.BatchSize, nil, log)
+		}
 	}
-	gz.Close()
-	return bf.Bytes(), nil
 }
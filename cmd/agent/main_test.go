@@ -1,8 +1,380 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/config"
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+	"github.com/lionslon/go-yapmetrics/internal/grpcserver"
+	"github.com/lionslon/go-yapmetrics/internal/handlers"
+	"github.com/lionslon/go-yapmetrics/internal/middlewares"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/pb"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func TestWebhook(t *testing.T) {
 }
+
+func newTestServer(t *testing.T, key string) (*httptest.Server, *storage.MemStorage) {
+	st := storage.NewMem()
+	h := handlers.New(st)
+	e := echo.New()
+	e.Use(middlewares.GzipUnpacking())
+	if key != "" {
+		e.Use(middlewares.SignResponse(key))
+		e.Use(middlewares.CheckSignReq(key))
+	}
+	e.POST("/updates/", h.UpdatesJSON())
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv, st
+}
+
+func newTestSender(url, key string) *httpSender {
+	client := retryablehttp.NewClient()
+	client.RetryMax = 0
+	return &httpSender{client: client, url: url, password: key}
+}
+
+func testMetrics(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		v := float64(i)
+		metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: "gauge", Value: &v})
+	}
+	return metrics
+}
+
+func TestSplitBatch(t *testing.T) {
+	metrics := testMetrics(30)
+	largest := 0
+	for i := range metrics {
+		js, err := json.Marshal(metrics[i : i+1])
+		require.NoError(t, err)
+		largest = max(largest, len(js))
+	}
+
+	testCases := []struct {
+		name     string
+		maxBytes int
+		want     int
+	}{
+		{name: "no limit", maxBytes: 0, want: 1},
+		{name: "everything fits", maxBytes: 1 << 20, want: 1},
+		{name: "one metric per batch", maxBytes: largest, want: 30},
+		{name: "limit below one metric", maxBytes: 1, want: 30},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			batches := splitBatch(metrics, test.maxBytes, zap.NewNop())
+			assert.Len(t, batches, test.want)
+
+			total := 0
+			for _, b := range batches {
+				total += len(b)
+				js, err := json.Marshal(b)
+				require.NoError(t, err)
+				if test.maxBytes >= largest {
+					assert.LessOrEqual(t, len(js), test.maxBytes)
+				}
+			}
+			assert.Equal(t, len(metrics), total)
+		})
+	}
+}
+
+func TestPostBatch(t *testing.T) {
+	srv, st := newTestServer(t, "secret")
+
+	delta := int64(7)
+	batch := append(testMetrics(3), models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	require.NoError(t, newTestSender(srv.URL+"/updates/", "secret").postBatch(context.Background(), batch))
+
+	ctx := context.Background()
+	v, err := st.GetCounterValue(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), v)
+	g, err := st.GetGaugeValue(ctx, "Gauge2")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, g)
+
+	assert.Error(t, newTestSender(srv.URL+"/updates/", "wrong").postBatch(context.Background(), batch))
+}
+
+func TestPostBatchRequiresSignedResponse(t *testing.T) {
+	e := echo.New()
+	e.POST("/updates/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, models.BatchResult{Applied: 1})
+	})
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	err := newTestSender(srv.URL+"/updates/", "secret").postBatch(context.Background(), testMetrics(1))
+	assert.ErrorContains(t, err, "invalid signature")
+}
+
+func TestPostBatchDropsRejectedMetrics(t *testing.T) {
+	srv, st := newTestServer(t, "")
+
+	batch := append(testMetrics(2), models.Metrics{ID: "Broken", MType: "gauge"})
+	require.NoError(t, newTestSender(srv.URL+"/updates/", "").postBatch(context.Background(), batch))
+
+	ctx := context.Background()
+	_, err := st.GetGaugeValue(ctx, "Gauge1")
+	assert.NoError(t, err)
+	_, err = st.GetGaugeValue(ctx, "Broken")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestPostBatchEncrypted(t *testing.T) {
+	privPEM, pubPEM, err := encryption.GenerateKeys(2048)
+	require.NoError(t, err)
+	priv, err := encryption.ParsePrivateKey(privPEM)
+	require.NoError(t, err)
+	pub, err := encryption.ParsePublicKey(pubPEM)
+	require.NoError(t, err)
+
+	st := storage.NewMem()
+	e := echo.New()
+	e.Use(middlewares.Decrypt(priv))
+	e.Use(middlewares.GzipUnpacking())
+	e.Use(middlewares.SignResponse("secret"))
+	e.Use(middlewares.CheckSignReq("secret"))
+	e.POST("/updates/", handlers.New(st).UpdatesJSON())
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	s := newTestSender(srv.URL+"/updates/", "secret")
+	assert.Error(t, s.postBatch(context.Background(), testMetrics(1)), "plaintext body must be rejected")
+
+	s.publicKey = pub
+	require.NoError(t, s.postBatch(context.Background(), testMetrics(500)))
+	g, err := st.GetGaugeValue(context.Background(), "Gauge499")
+	require.NoError(t, err)
+	assert.Equal(t, 499.0, g)
+}
+
+func TestGRPCSender(t *testing.T) {
+	st := storage.NewMem()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpcserver.New(st, grpcserver.Config{SignPass: "secret"})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	s := &grpcSender{client: pb.NewMetricsClient(conn), password: "secret"}
+	batch := append(testMetrics(2), models.Metrics{ID: "Broken", MType: "gauge"})
+	require.NoError(t, s.postBatch(context.Background(), batch))
+
+	ctx := context.Background()
+	g, err := st.GetGaugeValue(ctx, "Gauge1")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, g)
+	_, err = st.GetGaugeValue(ctx, "Broken")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	s.password = "wrong"
+	assert.Error(t, s.postBatch(context.Background(), testMetrics(1)))
+}
+
+func TestNewSenderRequiresGRPCAddr(t *testing.T) {
+	_, _, err := newSender(&config.ClientConfig{Transport: "grpc"}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestOutboundIP(t *testing.T) {
+	ip, err := outboundIP("127.0.0.1:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+}
+
+func TestMetricsStateTakeRestore(t *testing.T) {
+	ms := newMetricsState(nil)
+	getMetrics(ms)
+	getMetrics(ms)
+
+	metrics, pc := ms.take()
+	assert.Equal(t, int64(2), pc)
+	ids := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		ids[m.ID] = true
+	}
+	assert.True(t, ids["Alloc"])
+	assert.True(t, ids["PollCount"])
+	assert.True(t, ids["RandomValue"])
+
+	_, pc = ms.take()
+	assert.Equal(t, int64(0), pc, "PollCount must be taken only once")
+
+	ms.restorePollCount(2)
+	getMetrics(ms)
+	_, pc = ms.take()
+	assert.Equal(t, int64(3), pc)
+}
+
+func TestWorkersLimitConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, total atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+		total.Add(1)
+	}))
+	defer srv.Close()
+
+	const rateLimit = 2
+	s := newTestSender(srv.URL, "")
+	ms := newMetricsState(nil)
+	jobs := make(chan job, rateLimit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < rateLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(context.Background(), s, ms, jobs)
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		jobs <- job{batch: testMetrics(1)}
+	}
+	close(jobs)
+	wg.Wait()
+
+	assert.Equal(t, int32(10), total.Load())
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(rateLimit))
+}
+
+func TestWorkerSendsRequestID(t *testing.T) {
+	var mu sync.Mutex
+	ids := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids[r.Header.Get("X-Request-ID")] = true
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	jobs := make(chan job, 2)
+	jobs <- job{batch: testMetrics(1)}
+	jobs <- job{batch: testMetrics(1)}
+	close(jobs)
+	worker(context.Background(), newTestSender(srv.URL, ""), newMetricsState(nil), jobs)
+
+	assert.Len(t, ids, 2, "every batch must get its own request id")
+	assert.False(t, ids[""])
+}
+
+func TestFinalReportStopsAtDeadline(t *testing.T) {
+	ms := newMetricsState(nil)
+	getMetrics(ms)
+	jobs := make(chan job)
+	deadline := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(deadline) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		report(ms, jobs, 64, deadline, zap.NewNop())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("final report blocked on a full queue after the deadline")
+	}
+}
+
+func TestReportSkipsWhenQueueIsFull(t *testing.T) {
+	ms := newMetricsState(nil)
+	getMetrics(ms)
+	jobs := make(chan job, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		report(ms, jobs, 64, nil, zap.NewNop())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("report blocked on a full queue")
+	}
+
+	assert.Len(t, jobs, 1)
+	queued := <-jobs
+	_, pc := ms.take()
+	assert.Equal(t, int64(1), pc+queued.pollCount, "PollCount must be either queued or returned to the state")
+}
+
+func TestRunSendsFinalReportOnShutdown(t *testing.T) {
+	srv, st := newTestServer(t, "")
+	cfg := &config.ClientConfig{
+		Addr:           strings.TrimPrefix(srv.URL, "http://"),
+		PollInterval:   3600,
+		ReportInterval: 3600,
+		RateLimit:      1,
+		Instance:       "test-agent",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, run(ctx, cfg))
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	key := models.SeriesKey("RandomValue", map[string]string{"host": host, "instance": "test-agent"})
+	_, err = st.GetGaugeValue(context.Background(), key)
+	assert.NoError(t, err, "final report must reach the server with agent labels")
+}
+
+func TestAgentLabelsDefaultInstance(t *testing.T) {
+	labels := agentLabels("", zap.NewNop())
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, host, labels["host"])
+	assert.Equal(t, host, labels["instance"])
+	assert.Equal(t, labels, agentLabels("", zap.NewNop()), "labels must survive an agent restart")
+	assert.Equal(t, "test-agent", agentLabels("test-agent", zap.NewNop())["instance"])
+}
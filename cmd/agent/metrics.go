@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/lionslon/go-yapmetrics/internal/collector"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"go.uber.org/zap"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// metricsState собранные агентом метрики. Сборщики пишут в него, отправка забирает снимок,
+// поэтому медленный сервер не задерживает опрос.
+type metricsState struct {
+	mu        sync.Mutex
+	gauges    map[string]float64
+	pollCount int64
+	labels    map[string]string // метки, которые получает каждая отправленная метрика
+}
+
+func newMetricsState(labels map[string]string) *metricsState {
+	return &metricsState{
+		gauges: make(map[string]float64),
+		labels: labels,
+	}
+}
+
+// agentLabels метки host и instance, по которым сервер различает агентов.
+// Если instance не задан, он равен имени хоста: метки не должны меняться между
+// перезапусками, иначе каждый запуск создаёт на сервере новые серии. Нескольким
+// агентам на одном хосте instance нужно задавать явно.
+func agentLabels(instance string, log *zap.Logger) map[string]string {
+	labels := make(map[string]string, 2)
+	host, err := os.Hostname()
+	if err != nil {
+		log.Warn("host label is not set", zap.Error(err))
+	} else {
+		labels["host"] = host
+	}
+	if instance == "" {
+		instance = host
+	}
+	if instance != "" {
+		labels["instance"] = instance
+	}
+	return labels
+}
+
+func (s *metricsState) setGauges(values map[string]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range values {
+		s.gauges[k] = v
+	}
+}
+
+func (s *metricsState) incPollCount() {
+	s.mu.Lock()
+	s.pollCount++
+	s.mu.Unlock()
+}
+
+// take возвращает метрики для отправки и забирает накопленный PollCount.
+// Если отправить его не удалось, значение нужно вернуть через restorePollCount.
+func (s *metricsState) take() ([]models.Metrics, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(s.gauges)+2)
+	for k, v := range s.gauges {
+		v := v
+		metrics = append(metrics, models.Metrics{ID: k, MType: "gauge", Value: &v, Labels: s.labels})
+	}
+	pc := s.pollCount
+	s.pollCount = 0
+	metrics = append(metrics, models.Metrics{ID: "PollCount", MType: "counter", Delta: &pc, Labels: s.labels})
+	r := rand.Float64()
+	metrics = append(metrics, models.Metrics{ID: "RandomValue", MType: "gauge", Value: &r, Labels: s.labels})
+	return metrics, pc
+}
+
+func (s *metricsState) restorePollCount(pc int64) {
+	s.mu.Lock()
+	s.pollCount += pc
+	s.mu.Unlock()
+}
+
+func getMetrics(ms *metricsState) {
+	var rtm runtime.MemStats
+	runtime.ReadMemStats(&rtm)
+
+	valuesGauge := make(map[string]float64, 27)
+	valuesGauge["Alloc"] = float64(rtm.Alloc)
+	valuesGauge["BuckHashSys"] = float64(rtm.BuckHashSys)
+	valuesGauge["Frees"] = float64(rtm.Frees)
+	valuesGauge["GCCPUFraction"] = float64(rtm.GCCPUFraction)
+	valuesGauge["HeapAlloc"] = float64(rtm.HeapAlloc)
+	valuesGauge["HeapIdle"] = float64(rtm.HeapIdle)
+	valuesGauge["HeapInuse"] = float64(rtm.HeapInuse)
+	valuesGauge["HeapObjects"] = float64(rtm.HeapObjects)
+	valuesGauge["HeapReleased"] = float64(rtm.HeapReleased)
+	valuesGauge["HeapSys"] = float64(rtm.HeapSys)
+	valuesGauge["LastGC"] = float64(rtm.LastGC)
+	valuesGauge["Lookups"] = float64(rtm.Lookups)
+	valuesGauge["MCacheInuse"] = float64(rtm.MCacheInuse)
+	valuesGauge["MCacheSys"] = float64(rtm.MCacheSys)
+	valuesGauge["MSpanInuse"] = float64(rtm.MSpanInuse)
+	valuesGauge["MSpanSys"] = float64(rtm.MSpanSys)
+	valuesGauge["Mallocs"] = float64(rtm.Mallocs)
+	valuesGauge["NextGC"] = float64(rtm.NextGC)
+	valuesGauge["NumForcedGC"] = float64(rtm.NumForcedGC)
+	valuesGauge["NumGC"] = float64(rtm.NumGC)
+	valuesGauge["OtherSys"] = float64(rtm.OtherSys)
+	valuesGauge["PauseTotalNs"] = float64(rtm.PauseTotalNs)
+	valuesGauge["StackInuse"] = float64(rtm.StackInuse)
+	valuesGauge["StackSys"] = float64(rtm.StackSys)
+	valuesGauge["Sys"] = float64(rtm.Sys)
+	valuesGauge["TotalAlloc"] = float64(rtm.TotalAlloc)
+
+	ms.setGauges(valuesGauge)
+	ms.incPollCount()
+}
+
+func getSystemMetrics(sys *collector.System, ms *metricsState, log *zap.Logger) {
+	values, err := sys.Collect()
+	if err != nil {
+		log.Warn("cannot collect system metrics", zap.Error(err))
+	}
+	ms.setGauges(values)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/sign"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+func newClient() *retryablehttp.Client {
+	client := retryablehttp.NewClient()
+	client.RetryMax = 3
+	client.RetryWaitMin = time.Second * 1
+	client.RetryWaitMax = time.Second * 5
+	return client
+}
+
+// batchSender отправляет один пакет метрик на сервер.
+type batchSender interface {
+	postBatch(ctx context.Context, batch []models.Metrics) error
+}
+
+// httpSender отправляет пакеты метрик на /updates/ сервера. При заданном publicKey
+// тело запроса шифруется после сжатия, realIP уходит в заголовке X-Real-IP.
+type httpSender struct {
+	client    *retryablehttp.Client
+	url       string
+	password  string
+	publicKey *rsa.PublicKey
+	realIP    string
+}
+
+// outboundIP возвращает адрес интерфейса, через который агент ходит к серверу addr.
+// UDP-сокет только выбирает маршрут, пакеты не отправляются.
+func outboundIP(addr string) (string, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// detectRealIP возвращает outboundIP или пустую строку, если адрес определить не удалось.
+func detectRealIP(addr string, log *zap.Logger) string {
+	ip, err := outboundIP(addr)
+	if err != nil {
+		log.Warn("cannot detect outbound address for X-Real-IP", zap.Error(err))
+	}
+	return ip
+}
+
+// job пакет для отправки. pollCount равен приращению PollCount внутри пакета,
+// его нужно вернуть в metricsState, если пакет не дошёл до сервера.
+type job struct {
+	batch     []models.Metrics
+	pollCount int64
+}
+
+// report забирает собранные метрики и ставит пакеты в очередь воркерам.
+// Если очередь заполнена, пакет пропускается: gauge уйдут со следующим отчётом, PollCount возвращается.
+// Если передан deadline, report ждёт места в очереди, пока deadline не закрыт: так отправляется
+// последний отчёт перед остановкой. После закрытия deadline оставшиеся пакеты отбрасываются.
+func report(ms *metricsState, jobs chan<- job, batchSize int, deadline <-chan struct{}, log *zap.Logger) {
+	metrics, pc := ms.take()
+	for _, batch := range splitBatch(metrics, batchSize, log) {
+		j := job{batch: batch}
+		for _, m := range batch {
+			if m.ID == "PollCount" && m.MType == "counter" {
+				j.pollCount = pc
+			}
+		}
+		if deadline != nil {
+			select {
+			case jobs <- j:
+				continue
+			case <-deadline:
+				log.Warn("send queue is full at shutdown, dropping batch", zap.Int("metrics", len(batch)))
+				continue
+			}
+		}
+		select {
+		case jobs <- j:
+		default:
+			log.Warn("send queue is full, skipping batch", zap.Int("metrics", len(batch)))
+			ms.restorePollCount(j.pollCount)
+		}
+	}
+}
+
+// worker отправляет пакеты из очереди. Число воркеров ограничивает число одновременных запросов.
+// Каждый пакет получает свой идентификатор запроса, по нему запись в логе агента
+// находится в логе сервера.
+func worker(ctx context.Context, s batchSender, ms *metricsState, jobs <-chan job) {
+	for j := range jobs {
+		jobCtx := logger.WithRequestID(ctx, logger.NewRequestID())
+		if err := s.postBatch(jobCtx, j.batch); err != nil {
+			logger.FromContext(jobCtx).Error("cannot send batch", zap.Int("metrics", len(j.batch)), zap.Error(err))
+			ms.restorePollCount(j.pollCount)
+		}
+	}
+}
+
+// splitBatch делит метрики на пакеты, JSON каждого из которых не больше maxBytes.
+// Метрика, которая сама больше лимита, уходит отдельным пакетом. При maxBytes <= 0 пакет один.
+func splitBatch(metrics []models.Metrics, maxBytes int, log *zap.Logger) [][]models.Metrics {
+	if maxBytes <= 0 || len(metrics) == 0 {
+		return [][]models.Metrics{metrics}
+	}
+
+	batches := make([][]models.Metrics, 0, 1)
+	current := make([]models.Metrics, 0, len(metrics))
+	size := 2 // []
+	for _, m := range metrics {
+		js, err := json.Marshal(m)
+		if err != nil {
+			log.Error("cannot encode metric", zap.String("id", m.ID), zap.Error(err))
+			continue
+		}
+		itemSize := len(js)
+		if len(current) > 0 {
+			itemSize++ // запятая
+		}
+		if len(current) > 0 && size+itemSize > maxBytes {
+			batches = append(batches, current)
+			current = make([]models.Metrics, 0, len(metrics))
+			size = 2
+			itemSize = len(js)
+		}
+		current = append(current, m)
+		size += itemSize
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// postBatch отправляет пакет одним сжатым и подписанным запросом.
+// Если сервер отклонил отдельные метрики, они отбрасываются, а остальные отправляются повторно.
+func (s *httpSender) postBatch(ctx context.Context, batch []models.Metrics) error {
+	js, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	body, err := compress(js)
+	if err != nil {
+		return err
+	}
+	if s.publicKey != nil {
+		body, err = encryption.Encrypt(s.publicKey, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, "POST", s.url, body)
+	if err != nil {
+		return err
+	}
+
+	if s.password != "" {
+		req.Header.Add("HashSHA256", sign.Sum(js, []byte(s.password)))
+	}
+	if s.publicKey != nil {
+		req.Header.Add(encryption.Header, encryption.Scheme)
+	}
+	if s.realIP != "" {
+		req.Header.Add("X-Real-IP", s.realIP)
+	}
+	if id := logger.RequestID(ctx); id != "" {
+		req.Header.Add(logger.RequestIDHeader, id)
+	}
+
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("content-encoding", "gzip")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if s.password != "" && !sign.Valid(body, []byte(s.password), resp.Header.Get("HashSHA256")) {
+		return fmt.Errorf("response from %s has invalid signature", s.url)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		var result models.BatchResult
+		if err := json.Unmarshal(body, &result); err != nil || len(result.Errors) == 0 {
+			return fmt.Errorf("batch rejected: %s", body)
+		}
+		rest := withoutRejected(batch, result.Errors, logger.FromContext(ctx))
+		if len(rest) == 0 || len(rest) == len(batch) {
+			return fmt.Errorf("batch rejected: %s", body)
+		}
+		return s.postBatch(ctx, rest)
+	default:
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, s.url)
+	}
+}
+
+// withoutRejected возвращает метрики пакета, которые сервер не отклонил.
+func withoutRejected(batch []models.Metrics, rejectedItems []models.BatchItemError, log *zap.Logger) []models.Metrics {
+	rejected := make(map[int]bool, len(rejectedItems))
+	for _, e := range rejectedItems {
+		log.Warn("metric dropped by server", zap.String("id", e.ID), zap.String("reason", e.Reason))
+		rejected[e.Index] = true
+	}
+	rest := make([]models.Metrics, 0, len(batch))
+	for i, m := range batch {
+		if !rejected[i] {
+			rest = append(rest, m)
+		}
+	}
+	return rest
+}
+
+func compress(b []byte) ([]byte, error) {
+	var bf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&bf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	_, err = gz.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	gz.Close()
+	return bf.Bytes(), nil
+}
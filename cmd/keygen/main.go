@@ -0,0 +1,32 @@
+// keygen создаёт пару ключей RSA для флага -crypto-key: закрытый ключ нужен серверу,
+// открытый агенту.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+)
+
+func main() {
+	bits := flag.Int("bits", 4096, "RSA key size in bits")
+	out := flag.String("out", ".", "directory for private.pem and public.pem")
+	flag.Parse()
+
+	privPEM, pubPEM, err := encryption.GenerateKeys(*bits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "private.pem"), privPEM, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "public.pem"), pubPEM, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
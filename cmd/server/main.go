@@ -1,12 +1,41 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/lionslon/go-yapmetrics/internal/api"
+	"github.com/lionslon/go-yapmetrics/internal/config"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"go.uber.org/zap"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	s := api.New()
-	if err := s.Start(); err != nil {
-		panic(err)
+	cfg := config.NewServer()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	l, err := logger.New(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Sync()
+
+	s, err := api.New(cfg, l)
+	if err != nil {
+		l.Fatal("cannot create server", zap.Error(err))
+	}
+	if err = s.Start(ctx); err != nil {
+		l.Fatal("server stopped", zap.Error(err))
 	}
 }
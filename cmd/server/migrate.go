@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lionslon/go-yapmetrics/internal/config"
+	"github.com/lionslon/go-yapmetrics/internal/migrations"
+	"strconv"
+)
+
+// runMigrate обрабатывает подкоманду: server -d DSN migrate [up | down [N] | version].
+func runMigrate(cfg *config.ServerConfig, args []string) error {
+	if cfg.DatabaseDSN == "" {
+		return errors.New("migrate: database DSN is required (-d or DATABASE_DSN)")
+	}
+	db, err := sqlx.Open("postgres", cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	m, err := migrations.New(db.DB)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migrations\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: invalid number of steps %q", args[1])
+			}
+		}
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d migrations\n", n)
+	case "version":
+	default:
+		return fmt.Errorf("migrate: unknown command %q, expected up, down or version", cmd)
+	}
+
+	v, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d (latest %d)\n", v, m.Latest())
+	return nil
+}
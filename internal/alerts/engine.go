@@ -0,0 +1,302 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// State состояние оповещения. Оповещение становится pending, когда условие правила
+// выполнилось, firing, когда оно держится дольше For, и resolved, когда условие
+// перестало выполняться после firing. Pending без firing просто исчезает.
+type State string
+
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// resolvedRetention сколько решённое оповещение остаётся в списке /alerts.
+const resolvedRetention = 15 * time.Minute
+
+// maxUnsent сколько неотправленных оповещений хранится для повторной отправки.
+// При переполнении отбрасываются самые старые.
+const maxUnsent = 1000
+
+// Alert оповещение по одной серии. Value значение, на котором сработало условие:
+// текущее значение, скорость в секунду или сколько секунд серия не обновлялась.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	ID          string            `json:"id"`
+	MType       string            `json:"type"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	State       State             `json:"state"`
+	Value       float64           `json:"value"`
+	Description string            `json:"description,omitempty"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+}
+
+// Notifier получает оповещения, которые перешли в firing или resolved.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+// Engine периодически проверяет правила по метрикам хранилища.
+type Engine struct {
+	store    storage.MetricsStore
+	rules    []Rule
+	notifier Notifier
+	started  time.Time
+
+	mu     sync.Mutex
+	alerts map[string]*Alert
+	unsent []Alert // оповещения, которые notifier не принял, отправляются при следующей проверке
+}
+
+// NewEngine создаёт движок правил. notifier может быть nil, тогда оповещения
+// только видны в Alerts.
+func NewEngine(store storage.MetricsStore, rules []Rule, notifier Notifier) *Engine {
+	return &Engine{
+		store:    store,
+		rules:    rules,
+		notifier: notifier,
+		started:  time.Now(),
+		alerts:   make(map[string]*Alert),
+	}
+}
+
+// Run проверяет правила каждые interval, пока не отменён ctx. Ошибки пишутся в логгер из ctx.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := e.Evaluate(ctx, now); err != nil {
+				logger.FromContext(ctx).Error("evaluate alerting rules", zap.Error(err))
+			}
+		}
+	}
+}
+
+// result проверки правила по одной серии.
+type result struct {
+	series models.Metrics
+	value  float64
+	active bool
+}
+
+// Evaluate проверяет все правила на момент now, обновляет состояния оповещений
+// и отправляет изменившиеся в notifier вместе с теми, что не удалось отправить раньше. Если правило проверить не удалось, его
+// оповещения остаются в прежнем состоянии до следующей проверки.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) error {
+	metrics, err := e.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Проверки обращаются к хранилищу, поэтому выполняются до блокировки: Alerts
+	// не ждёт всей проверки.
+	var errs []error
+	checked := make(map[string][]result, len(e.rules))
+	for _, r := range e.rules {
+		results, err := e.check(ctx, r, metrics, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", r.Name, err))
+			continue
+		}
+		checked[r.Name] = results
+	}
+
+	seen := make(map[string]bool)
+	var changed []Alert
+	e.mu.Lock()
+	for _, r := range e.rules {
+		results, ok := checked[r.Name]
+		if !ok {
+			continue
+		}
+		for _, res := range results {
+			key := r.Name + "/" + res.series.Key()
+			seen[key] = true
+			if a, ok := e.transition(key, r, res, now); ok {
+				changed = append(changed, a)
+			}
+		}
+	}
+	for key, a := range e.alerts {
+		if _, ok := checked[a.Rule]; !ok || seen[key] {
+			continue
+		}
+		// серия пропала из хранилища: условие по ней больше не выполняется
+		if a, ok := e.transition(key, Rule{}, result{}, now); ok {
+			changed = append(changed, a)
+		}
+	}
+	var send []Alert
+	if e.notifier != nil {
+		send = append(e.unsent, changed...)
+		e.unsent = nil
+	}
+	e.mu.Unlock()
+
+	if len(send) > 0 {
+		if err := e.notifier.Notify(ctx, send); err != nil {
+			errs = append(errs, err)
+			e.mu.Lock()
+			e.unsent = append(send, e.unsent...)
+			if n := len(e.unsent) - maxUnsent; n > 0 {
+				e.unsent = e.unsent[n:]
+			}
+			e.mu.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// transition обновляет оповещение key по результату проверки и возвращает его копию,
+// если оно перешло в firing или resolved. Вызывается под e.mu.
+func (e *Engine) transition(key string, r Rule, res result, now time.Time) (Alert, bool) {
+	a, ok := e.alerts[key]
+	if !res.active {
+		if !ok {
+			return Alert{}, false
+		}
+		switch a.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			a.State = StateResolved
+			a.ResolvedAt = &now
+			if res.series.ID != "" {
+				a.Value = res.value
+			}
+			return *a, true
+		case StateResolved:
+			if now.Sub(*a.ResolvedAt) > resolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+		return Alert{}, false
+	}
+
+	if !ok || a.State == StateResolved {
+		a = &Alert{
+			Rule:        r.Name,
+			ID:          res.series.ID,
+			MType:       res.series.MType,
+			Labels:      res.series.Labels,
+			State:       StatePending,
+			Description: r.Description,
+			ActiveAt:    now,
+		}
+		e.alerts[key] = a
+	}
+	a.Value = res.value
+	if a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(r.For) {
+		a.State = StateFiring
+		a.FiredAt = &now
+		return *a, true
+	}
+	return Alert{}, false
+}
+
+// check проверяет правило по всем подходящим сериям.
+func (e *Engine) check(ctx context.Context, r Rule, metrics []models.Metrics, now time.Time) ([]result, error) {
+	var results []result
+	for _, m := range metrics {
+		if !r.matches(m) {
+			continue
+		}
+		res := result{series: models.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}}
+		switch r.Condition {
+		case ConditionThreshold:
+			res.value = metricValue(m)
+			res.active = comparators[r.Op](res.value, r.Value)
+		case ConditionRate:
+			samples, err := e.store.History(ctx, m.MType, m.Key(), now.Add(-time.Duration(r.Window)), now)
+			if err != nil {
+				return nil, err
+			}
+			if len(samples) < 2 {
+				break
+			}
+			res.value = rate(samples, m.MType == "counter")
+			res.active = comparators[r.Op](res.value, r.Value)
+		case ConditionAbsent:
+			res.value = now.Sub(m.UpdatedAt).Seconds()
+			res.active = now.Sub(m.UpdatedAt) > time.Duration(r.Window)
+		}
+		results = append(results, res)
+	}
+
+	// Серии, которой ни разу не было, тоже считаются отсутствующими: отсчёт идёт от запуска движка.
+	if len(results) == 0 && r.Condition == ConditionAbsent {
+		res := result{series: models.Metrics{ID: r.Metric, MType: r.Type, Labels: r.Labels}}
+		res.value = now.Sub(e.started).Seconds()
+		res.active = now.Sub(e.started) > time.Duration(r.Window)
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func metricValue(m models.Metrics) float64 {
+	if m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+// rate скорость изменения в секунду между первым и последним значением.
+// Для счётчика уменьшение считается сбросом, и прирост после него считается от нуля.
+func rate(samples []models.Sample, counter bool) float64 {
+	first, last := samples[0], samples[len(samples)-1]
+	dt := last.Time.Sub(first.Time).Seconds()
+	if dt <= 0 {
+		return 0
+	}
+	if !counter {
+		return (last.Value - first.Value) / dt
+	}
+	var increase float64
+	for i := 1; i < len(samples); i++ {
+		d := samples[i].Value - samples[i-1].Value
+		if d < 0 {
+			d = samples[i].Value
+		}
+		increase += d
+	}
+	return increase / dt
+}
+
+// Alerts возвращает текущие оповещения, отсортированные по правилу и серии.
+func (e *Engine) Alerts() []Alert {
+	e.mu.Lock()
+	keys := make([]string, 0, len(e.alerts))
+	for k := range e.alerts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]Alert, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, *e.alerts[k])
+	}
+	e.mu.Unlock()
+	return result
+}
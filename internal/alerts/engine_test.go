@@ -0,0 +1,317 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore хранилище в памяти, у которого время обновления и история задаются тестом.
+type fakeStore struct {
+	*storage.MemStorage
+	updated    map[string]time.Time
+	history    map[string][]models.Sample
+	historyErr error
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		MemStorage: storage.NewMem(),
+		updated:    make(map[string]time.Time),
+		history:    make(map[string][]models.Sample),
+	}
+}
+
+func (s *fakeStore) List(ctx context.Context) ([]models.Metrics, error) {
+	metrics, err := s.MemStorage.List(ctx)
+	for i := range metrics {
+		if t, ok := s.updated[metrics[i].Key()]; ok {
+			metrics[i].UpdatedAt = t
+		}
+	}
+	return metrics, err
+}
+
+func (s *fakeStore) History(_ context.Context, _, key string, from, to time.Time) ([]models.Sample, error) {
+	if s.historyErr != nil {
+		return nil, s.historyErr
+	}
+	var result []models.Sample
+	for _, smp := range s.history[key] {
+		if !smp.Time.Before(from) && !smp.Time.After(to) {
+			result = append(result, smp)
+		}
+	}
+	return result, nil
+}
+
+// webhookReceiver поднимает HTTP-сервер, который запоминает присланные оповещения.
+// Первые failures запросов получают ответ 503.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	alerts   []Alert
+	failures int
+}
+
+func (w *webhookReceiver) start(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		var p webhookPayload
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&p)) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.failures > 0 {
+			w.failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.alerts = append(w.alerts, p.Alerts...)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (w *webhookReceiver) received() []Alert {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Alert(nil), w.alerts...)
+}
+
+func TestParseRules(t *testing.T) {
+	yamlRules := `
+rules:
+  - name: HeapHigh
+    metric: HeapAlloc
+    type: gauge
+    labels: {host: web-1}
+    condition: threshold
+    op: ">"
+    value: 100
+    for: 1m
+  - name: Stalled
+    metric: PollCount
+    type: counter
+    condition: absent
+    window: 30
+`
+	rules, err := ParseRules([]byte(yamlRules))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, Duration(time.Minute), rules[0].For)
+	assert.Equal(t, map[string]string{"host": "web-1"}, rules[0].Labels)
+	assert.Equal(t, Duration(30*time.Second), rules[1].Window)
+
+	jsonRules := `{"rules":[{"name":"Growth","metric":"PollCount","type":"counter","condition":"rate","op":">=","value":5,"window":"5m"}]}`
+	rules, err = ParseRules([]byte(jsonRules))
+	require.NoError(t, err)
+	assert.Equal(t, Duration(5*time.Minute), rules[0].Window)
+
+	invalid := []string{
+		`{"rules":[{"name":"x","metric":"m","type":"summary","condition":"threshold","op":">"}]}`,
+		`{"rules":[{"name":"x","metric":"m","type":"gauge","condition":"threshold","op":"=>"}]}`,
+		`{"rules":[{"name":"x","metric":"m","type":"gauge","condition":"rate","op":">"}]}`,
+		`{"rules":[{"name":"x","metric":"m","type":"gauge","condition":"spike"}]}`,
+		`{"rules":[{"name":"x","metric":"m","type":"gauge","condition":"absent","window":"1m"},{"name":"x","metric":"m","type":"gauge","condition":"absent","window":"1m"}]}`,
+	}
+	for _, body := range invalid {
+		_, err := ParseRules([]byte(body))
+		assert.Error(t, err, body)
+	}
+}
+
+func TestEngineThreshold(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	var recv webhookReceiver
+	srv := recv.start(t)
+	rules := []Rule{{
+		Name: "HeapHigh", Metric: "HeapAlloc", Type: "gauge", Labels: map[string]string{"host": "web-1"},
+		Condition: ConditionThreshold, Op: ">", Value: 100, For: Duration(time.Minute),
+	}}
+	e := NewEngine(st, rules, NewWebhook(srv.URL))
+
+	web1 := models.SeriesKey("HeapAlloc", map[string]string{"host": "web-1"})
+	web2 := models.SeriesKey("HeapAlloc", map[string]string{"host": "web-2"})
+	require.NoError(t, st.UpdateGauge(ctx, web1, 150))
+	require.NoError(t, st.UpdateGauge(ctx, web2, 500))
+
+	start := time.Now()
+	require.NoError(t, e.Evaluate(ctx, start))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1, "web-2 does not match the rule labels")
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, 150.0, alerts[0].Value)
+	assert.Empty(t, recv.received(), "pending alerts are not sent")
+
+	require.NoError(t, e.Evaluate(ctx, start.Add(time.Minute)))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	require.Len(t, recv.received(), 1)
+	assert.Equal(t, StateFiring, recv.received()[0].State)
+	assert.Equal(t, map[string]string{"host": "web-1"}, recv.received()[0].Labels)
+
+	require.NoError(t, e.Evaluate(ctx, start.Add(2*time.Minute)))
+	assert.Len(t, recv.received(), 1, "firing is sent once")
+
+	require.NoError(t, st.UpdateGauge(ctx, web1, 50))
+	require.NoError(t, e.Evaluate(ctx, start.Add(3*time.Minute)))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	assert.Equal(t, 50.0, alerts[0].Value)
+	require.Len(t, recv.received(), 2)
+	assert.Equal(t, StateResolved, recv.received()[1].State)
+	assert.NotNil(t, recv.received()[1].ResolvedAt)
+
+	require.NoError(t, e.Evaluate(ctx, start.Add(3*time.Minute+resolvedRetention+time.Second)))
+	assert.Empty(t, e.Alerts(), "resolved alerts expire")
+}
+
+func TestEnginePendingDropped(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	rules := []Rule{{Name: "Low", Metric: "Free", Type: "gauge", Condition: ConditionThreshold, Op: "<", Value: 10, For: Duration(time.Minute)}}
+	e := NewEngine(st, rules, nil)
+
+	require.NoError(t, st.UpdateGauge(ctx, "Free", 5))
+	now := time.Now()
+	require.NoError(t, e.Evaluate(ctx, now))
+	require.Len(t, e.Alerts(), 1)
+
+	require.NoError(t, st.UpdateGauge(ctx, "Free", 20))
+	require.NoError(t, e.Evaluate(ctx, now.Add(30*time.Second)))
+	assert.Empty(t, e.Alerts())
+}
+
+func TestEngineRate(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	var recv webhookReceiver
+	srv := recv.start(t)
+	rules := []Rule{{Name: "Growth", Metric: "PollCount", Type: "counter", Condition: ConditionRate, Op: ">", Value: 1, Window: Duration(time.Minute)}}
+	e := NewEngine(st, rules, NewWebhook(srv.URL))
+
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 1))
+	now := time.Now()
+	// 30 -> 90 за минуту со сбросом посередине: прирост 60 + 30 = 90, 1.5 в секунду
+	st.history["PollCount"] = []models.Sample{
+		{Time: now.Add(-2 * time.Minute), Value: 0},
+		{Time: now.Add(-time.Minute), Value: 30},
+		{Time: now.Add(-30 * time.Second), Value: 90},
+		{Time: now, Value: 30},
+	}
+	require.NoError(t, e.Evaluate(ctx, now))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.InDelta(t, 1.5, alerts[0].Value, 1e-9)
+	require.Len(t, recv.received(), 1)
+
+	st.history["PollCount"] = append(st.history["PollCount"], models.Sample{Time: now.Add(time.Minute), Value: 40})
+	require.NoError(t, e.Evaluate(ctx, now.Add(time.Minute)))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+}
+
+func TestEngineKeepsAlertsOfFailedRule(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	var recv webhookReceiver
+	srv := recv.start(t)
+	rules := []Rule{{Name: "Growth", Metric: "PollCount", Type: "counter", Condition: ConditionRate, Op: ">", Value: 1, Window: Duration(time.Minute)}}
+	e := NewEngine(st, rules, NewWebhook(srv.URL))
+
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 1))
+	now := time.Now()
+	st.history["PollCount"] = []models.Sample{{Time: now.Add(-time.Minute), Value: 0}, {Time: now, Value: 120}}
+	require.NoError(t, e.Evaluate(ctx, now))
+	require.Len(t, recv.received(), 1)
+
+	st.historyErr = errors.New("connection reset")
+	assert.Error(t, e.Evaluate(ctx, now.Add(time.Second)))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State, "a failed check must not resolve the alert")
+	assert.Len(t, recv.received(), 1, "no resolved notification for a failed check")
+}
+
+func TestEngineRetriesFailedNotifications(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	recv := webhookReceiver{failures: 1}
+	srv := recv.start(t)
+	rules := []Rule{{Name: "HeapHigh", Metric: "HeapAlloc", Type: "gauge", Condition: ConditionThreshold, Op: ">", Value: 100}}
+	e := NewEngine(st, rules, NewWebhook(srv.URL))
+
+	require.NoError(t, st.UpdateGauge(ctx, "HeapAlloc", 150))
+	now := time.Now()
+	assert.Error(t, e.Evaluate(ctx, now))
+	assert.Empty(t, recv.received())
+
+	require.NoError(t, st.UpdateGauge(ctx, "HeapAlloc", 50))
+	require.NoError(t, e.Evaluate(ctx, now.Add(time.Second)))
+	received := recv.received()
+	require.Len(t, received, 2, "the failed firing notification must be sent again")
+	assert.Equal(t, StateFiring, received[0].State)
+	assert.Equal(t, StateResolved, received[1].State)
+
+	require.NoError(t, e.Evaluate(ctx, now.Add(2*time.Second)))
+	assert.Len(t, recv.received(), 2, "delivered notifications are not repeated")
+}
+
+func TestEngineAbsent(t *testing.T) {
+	ctx := context.Background()
+	st := newFakeStore()
+	var recv webhookReceiver
+	srv := recv.start(t)
+	rules := []Rule{
+		{Name: "Stalled", Metric: "PollCount", Type: "counter", Condition: ConditionAbsent, Window: Duration(30 * time.Second)},
+		{Name: "Missing", Metric: "Heartbeat", Type: "gauge", Condition: ConditionAbsent, Window: Duration(time.Minute)},
+	}
+	e := NewEngine(st, rules, NewWebhook(srv.URL))
+
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 1))
+	now := time.Now()
+	st.updated["PollCount"] = now.Add(-45 * time.Second)
+
+	require.NoError(t, e.Evaluate(ctx, now))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1, "Heartbeat is missing for less than the window")
+	assert.Equal(t, "Stalled", alerts[0].Rule)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.InDelta(t, 45, alerts[0].Value, 1e-9)
+
+	require.NoError(t, e.Evaluate(ctx, now.Add(2*time.Minute)))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "Missing", alerts[0].Rule)
+	assert.Equal(t, "Heartbeat", alerts[0].ID)
+	assert.Equal(t, StateFiring, alerts[0].State)
+
+	require.NoError(t, st.UpdateGauge(ctx, "Heartbeat", 1))
+	st.updated["Heartbeat"] = now.Add(2*time.Minute + time.Second)
+	require.NoError(t, e.Evaluate(ctx, now.Add(2*time.Minute+2*time.Second)))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 2)
+	assert.Equal(t, StateResolved, alerts[0].State)
+
+	received := recv.received()
+	require.Len(t, received, 3)
+	assert.Equal(t, "Missing", received[2].Rule)
+	assert.Equal(t, StateResolved, received[2].State)
+}
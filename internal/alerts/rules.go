@@ -0,0 +1,162 @@
+// Package alerts проверяет правила оповещений по метрикам хранилища.
+//
+// Правила загружаются из YAML или JSON (JSON читается тем же разборщиком YAML):
+//
+//	rules:
+//	  - name: HeapAllocHigh
+//	    metric: HeapAlloc
+//	    type: gauge
+//	    labels: {host: web-1}
+//	    condition: threshold
+//	    op: ">"
+//	    value: 1e9
+//	    for: 1m
+//	  - name: PollCountStalled
+//	    metric: PollCount
+//	    type: counter
+//	    condition: absent
+//	    window: 5m
+//
+// Условия: threshold сравнивает текущее значение с value, rate сравнивает скорость
+// изменения за window (в единицах в секунду), absent срабатывает, если серия
+// не обновлялась дольше window. Метки правила отбирают серии, у которых они есть.
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConditionThreshold = "threshold"
+	ConditionRate      = "rate"
+	ConditionAbsent    = "absent"
+)
+
+// Duration длительность в формате Go ("90s", "5m") или в секундах.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var sec int64
+	if err := value.Decode(&sec); err == nil {
+		*d = Duration(time.Duration(sec) * time.Second)
+		return nil
+	}
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule правило оповещения.
+type Rule struct {
+	Name        string            `yaml:"name"`
+	Metric      string            `yaml:"metric"`
+	Type        string            `yaml:"type"`
+	Labels      map[string]string `yaml:"labels"`
+	Condition   string            `yaml:"condition"`
+	Op          string            `yaml:"op"`
+	Value       float64           `yaml:"value"`
+	Window      Duration          `yaml:"window"`
+	For         Duration          `yaml:"for"` // сколько условие должно держаться до перехода в firing
+	Description string            `yaml:"description"`
+}
+
+type ruleFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadRules читает и проверяет файл правил.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+// ParseRules разбирает правила в YAML или JSON и проверяет их.
+func ParseRules(data []byte) ([]Rule, error) {
+	var f ruleFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("alert rules: %w", err)
+	}
+	names := make(map[string]bool, len(f.Rules))
+	for i, r := range f.Rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %d (%s): %w", i, r.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("alert rule %d: duplicate name %q", i, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return f.Rules, nil
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("empty name")
+	}
+	if r.Metric == "" {
+		return errors.New("empty metric")
+	}
+	if r.Type != "gauge" && r.Type != "counter" {
+		return errors.New("type can only be 'gauge' or 'counter'")
+	}
+	if err := models.ValidateLabels(r.Labels); err != nil {
+		return err
+	}
+	if r.For < 0 {
+		return errors.New("negative for")
+	}
+	switch r.Condition {
+	case ConditionThreshold:
+	case ConditionRate, ConditionAbsent:
+		if r.Window <= 0 {
+			return fmt.Errorf("%s condition needs a positive window", r.Condition)
+		}
+	default:
+		return fmt.Errorf("unknown condition %q, can only be threshold, rate or absent", r.Condition)
+	}
+	if r.Condition != ConditionAbsent {
+		if _, ok := comparators[r.Op]; !ok {
+			return fmt.Errorf("unknown op %q", r.Op)
+		}
+	}
+	return nil
+}
+
+var comparators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// matches проверяет, что серия m относится к правилу: совпадают имя и тип,
+// и у серии есть все метки правила с теми же значениями.
+func (r Rule) matches(m models.Metrics) bool {
+	if m.ID != r.Metric || m.MType != r.Type {
+		return false
+	}
+	for k, v := range r.Labels {
+		if lv, ok := m.Labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -1,77 +1,358 @@
 package api
 
 import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/alerts"
 	"github.com/lionslon/go-yapmetrics/internal/config"
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+	"github.com/lionslon/go-yapmetrics/internal/grpcserver"
 	"github.com/lionslon/go-yapmetrics/internal/handlers"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
 	"github.com/lionslon/go-yapmetrics/internal/middlewares"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
 	"github.com/lionslon/go-yapmetrics/internal/storage"
 	"go.uber.org/zap"
-	"log"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
+// shutdownTimeout сколько ждать завершения запросов, которые уже обрабатываются, при остановке сервера.
+const shutdownTimeout = 10 * time.Second
+
 type APIServer struct {
-	cfg  *config.ServerConfig
-	echo *echo.Echo
-	st   *storage.MemStorage
+	cfg      *config.ServerConfig
+	echo     *echo.Echo
+	grpc     *grpc.Server
+	internal *http.Server // собственные метрики сервера, отдельно от API
+	st       storage.MetricsStore
+	worker   storage.StorageWorker
+	alerts   *alerts.Engine
+	metrics  *selfmetrics.Metrics
+	log      *zap.Logger
 }
 
-func New() *APIServer {
+// New собирает сервер по конфигурации. Ошибка возвращается, если не удалось загрузить ключ -crypto-key
+// или разобрать -t: без них сервер не сможет расшифровать запросы агентов или проверить их адреса.
+// Также сервер не запускается с некорректным файлом правил -alert-rules и с правилами rate
+// при выключенной истории.
+// Все сообщения сервера, хранилища и обработчиков пишутся в log.
+func New(cfg *config.ServerConfig, log *zap.Logger) (*APIServer, error) {
 	apiS := &APIServer{}
-	cfg := config.NewServer()
 	apiS.cfg = cfg
+	apiS.log = log
 	apiS.echo = echo.New()
-	apiS.st = storage.NewMem()
+	apiS.echo.HideBanner = true
+	apiS.echo.HidePort = true
 
-	handler := handlers.New(apiS.st)
-	logger, _ := zap.NewDevelopment()
-	zap.ReplaceGlobals(logger)
-	defer logger.Sync()
+	var priv *rsa.PrivateKey
+	if cfg.CryptoKey != "" {
+		var err error
+		priv, err = encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	var storageProvider storage.StorageWorker
-	var err error
-	switch cfg.GetProvider() {
-	case storage.FileProvider:
-		storageProvider = storage.NewFileProvider(cfg.FilePath, cfg.StoreInterval, apiS.st)
-	case storage.DBProvider:
-		storageProvider, err = storage.NewDBProvider(cfg.DatabaseDSN, cfg.StoreInterval, apiS.st)
+	// writeMW и readMW подключаются к отдельным маршрутам: чтение может остаться открытым
+	// для адресов вне доверенной подсети.
+	var writeMW, readMW []echo.MiddlewareFunc
+	var subnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		var err error
+		_, subnet, err = net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("trusted subnet: %w", err)
+		}
+		writeMW = append(writeMW, middlewares.TrustedSubnet(subnet))
+		if !cfg.OpenReads {
+			readMW = append(readMW, middlewares.TrustedSubnet(subnet))
+		}
 	}
+
+	var err error
+	apiS.st, apiS.worker, err = newStore(cfg, log)
 	if err != nil {
-		zap.S().Error(err)
+		return nil, err
 	}
-	if cfg.Restore {
-		err := storageProvider.Restore()
-		if err != nil {
-			zap.S().Error(err)
+	handler := handlers.New(apiS.st)
+
+	apiS.metrics = selfmetrics.New(apiS.st)
+	if fs, ok := apiS.st.(*storage.FileStore); ok {
+		fs.SetDumpObserver(apiS.metrics.ObserveDump)
+	}
+	if cfg.InternalAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", apiS.metrics.Handler())
+		apiS.internal = &http.Server{
+			Addr:              cfg.InternalAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: shutdownTimeout,
+			BaseContext: func(net.Listener) context.Context {
+				return logger.WithContext(context.Background(), log)
+			},
 		}
 	}
 
-	if cfg.StoreIntervalNotZero() {
-		go storageProvider.IntervalDump()
+	if cfg.AlertRules != "" {
+		rules, err := alerts.LoadRules(cfg.AlertRules)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if r.Condition == alerts.ConditionRate && cfg.HistorySize <= 0 {
+				return nil, fmt.Errorf("rule %s: rate rules need history, set -history-size", r.Name)
+			}
+		}
+		var notifier alerts.Notifier
+		if cfg.AlertWebhook != "" {
+			notifier = alerts.NewWebhook(cfg.AlertWebhook)
+		}
+		apiS.alerts = alerts.NewEngine(apiS.st, rules, notifier)
 	}
 
+	apiS.echo.Use(middlewares.RequestID(log))
+	apiS.echo.Use(middlewares.Instrument(apiS.metrics))
 	apiS.echo.Use(middlewares.WithLogging())
+	if priv != nil {
+		apiS.echo.Use(middlewares.Decrypt(priv))
+	}
 	apiS.echo.Use(middlewares.GzipUnpacking())
 	if cfg.SignPass != "" {
+		apiS.echo.Use(middlewares.SignResponse(cfg.SignPass))
 		apiS.echo.Use(middlewares.CheckSignReq(cfg.SignPass))
 	}
 
-	apiS.echo.GET("/", handler.AllMetricsValues())
-	apiS.echo.POST("/value/", handler.GetValueJSON())
-	apiS.echo.GET("/value/:typeM/:nameM", handler.MetricsValue())
-	apiS.echo.POST("/update/", handler.UpdateJSON())
-	apiS.echo.POST("/update/:typeM/:nameM/:valueM", handler.UpdateMetrics())
-	apiS.echo.POST("/updates/", handler.UpdatesJSON())
-	apiS.echo.GET("/ping", handler.PingDB(storageProvider))
+	apiS.echo.GET("/", handler.AllMetricsValues(), readMW...)
+	apiS.echo.POST("/value/", handler.GetValueJSON(), readMW...)
+	apiS.echo.GET("/value/:typeM/:nameM", handler.MetricsValue(), readMW...)
+	apiS.echo.POST("/update/", handler.UpdateJSON(), writeMW...)
+	apiS.echo.POST("/update/:typeM/:nameM/:valueM", handler.UpdateMetrics(), writeMW...)
+	apiS.echo.POST("/updates/", handler.UpdatesJSON(), writeMW...)
+	apiS.echo.GET("/ping", handler.PingDB(), readMW...)
+	apiS.echo.GET("/metrics", handler.PrometheusMetrics(), readMW...)
+	apiS.echo.GET("/history/:typeM/:nameM", handler.MetricHistory(), readMW...)
+	apiS.echo.GET("/query", handler.Query(), readMW...)
+	apiS.echo.POST("/query", handler.Query(), readMW...)
+	apiS.echo.GET("/alerts", handler.Alerts(apiS.alerts), readMW...)
+	apiS.echo.POST("/admin/purge-stale", handler.PurgeStale(cfg.TTL()), writeMW...)
+	apiS.echo.DELETE("/value/:typeM/:nameM", handler.DeleteMetric(), writeMW...)
+	apiS.echo.DELETE("/values/", handler.DeleteByPrefix(), writeMW...)
+	apiS.echo.POST("/reset/counter/:nameM", handler.ResetCounter(), writeMW...)
 
-	return apiS
+	if cfg.GRPCAddr != "" {
+		apiS.grpc = grpcserver.New(apiS.st, grpcserver.Config{
+			SignPass:      cfg.SignPass,
+			TrustedSubnet: subnet,
+			OpenReads:     cfg.OpenReads,
+			Logger:        log,
+			Metrics:       apiS.metrics,
+		})
+	}
+
+	return apiS, nil
 }
 
-func (a *APIServer) Start() error {
-	err := a.echo.Start(a.cfg.Addr)
-	if err != nil {
-		log.Fatal(err)
+// stopGRPC дожидается текущих вызовов не дольше shutdownTimeout, затем обрывает их.
+func stopGRPC(s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.Stop()
 	}
+}
 
+// memStore хранилище в памяти, в которое записываются собственные метрики сервера.
+// У FileStore это его MemStorage: метрики сервера попадают в снимки, но не в журнал
+// и не вызывают сохранений в синхронном режиме. У DBStore такого хранилища нет.
+func memStore(st storage.MetricsStore) *storage.MemStorage {
+	switch st := st.(type) {
+	case *storage.MemStorage:
+		return st
+	case *storage.FileStore:
+		return st.MemStorage
+	}
 	return nil
 }
+
+// newStore выбирает хранилище по конфигурации. Для файлового хранилища дополнительно
+// возвращается StorageWorker, который сбрасывает данные на диск. Если задан DSN, но к БД
+// не удалось подключиться, возвращается ошибка: БД источник истины, и принятые
+// в память метрики пропали бы при перезапуске.
+func newStore(cfg *config.ServerConfig, log *zap.Logger) (storage.MetricsStore, storage.StorageWorker, error) {
+	switch cfg.GetProvider() {
+	case storage.DBProvider:
+		st, err := storage.NewDBStore(cfg.DatabaseDSN, log)
+		if err != nil {
+			return nil, nil, fmt.Errorf("database storage: %w", err)
+		}
+		st.SetHistory(cfg.History())
+		st.SetTTL(cfg.TTL())
+		return st, nil, nil
+	case storage.FileProvider:
+		st := storage.NewFileStore(cfg.FilePath, cfg.StoreInterval)
+		st.SetLogger(log)
+		st.SetHistory(cfg.History())
+		st.SetTTL(cfg.TTL())
+		if cfg.Restore {
+			err := st.Restore()
+			if err != nil {
+				log.Error("cannot restore metrics", zap.Error(err))
+			}
+		}
+		// В синхронном режиме без журнала каждое обновление переписывает весь снимок.
+		if cfg.Journal || !cfg.StoreIntervalNotZero() {
+			if err := st.EnableJournal(); err != nil {
+				log.Error("cannot enable journal", zap.Error(err))
+			}
+		}
+		return st, st, nil
+	}
+	st := storage.NewMem()
+	st.SetHistory(cfg.History())
+	st.SetTTL(cfg.TTL())
+	return st, nil, nil
+}
+
+// Start обслуживает запросы HTTP и, если заданы GRPCAddr и InternalAddr, gRPC и собственные
+// метрики сервера, пока не отменён ctx или один из серверов не остановился с ошибкой.
+// После этого сервер перестаёт принимать соединения, дожидается текущих запросов,
+// останавливает периодическое сохранение и сохраняет метрики последний раз.
+func (a *APIServer) Start(ctx context.Context) error {
+	var grpcListener, internalListener net.Listener
+	if a.grpc != nil {
+		var err error
+		grpcListener, err = net.Listen("tcp", a.cfg.GRPCAddr)
+		if err != nil {
+			return err
+		}
+	}
+	if a.internal != nil {
+		var err error
+		internalListener, err = net.Listen("tcp", a.internal.Addr)
+		if err != nil {
+			if grpcListener != nil {
+				grpcListener.Close()
+			}
+			return err
+		}
+	}
+
+	dumpCtx, stopDump := context.WithCancel(logger.WithContext(context.Background(), a.log))
+	defer stopDump()
+	var wg sync.WaitGroup
+	if a.worker != nil && a.cfg.StoreIntervalNotZero() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.worker.IntervalDump(dumpCtx)
+		}()
+	}
+	if p, ok := a.st.(storage.HistoryPruner); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.IntervalPrune(dumpCtx)
+		}()
+	}
+	if a.cfg.ExpireStale && a.cfg.TTL() > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			storage.ExpireStale(dumpCtx, a.st, a.cfg.TTL())
+		}()
+	}
+	if a.alerts != nil {
+		interval := time.Duration(a.cfg.AlertInterval) * time.Second
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.alerts.Run(dumpCtx, interval)
+		}()
+	}
+	if a.cfg.SelfMetrics > 0 {
+		if mem := memStore(a.st); mem != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.metrics.Feed(dumpCtx, mem, time.Duration(a.cfg.SelfMetrics)*time.Second)
+			}()
+		} else {
+			a.log.Warn("server metrics are not written to the database storage")
+		}
+	}
+
+	a.log.Info("starting server", zap.String("addr", a.cfg.Addr), zap.String("grpc_addr", a.cfg.GRPCAddr),
+		zap.String("internal_addr", a.cfg.InternalAddr))
+	errCh := make(chan error, 3)
+	go func() {
+		errCh <- a.echo.Start(a.cfg.Addr)
+	}()
+	if a.grpc != nil {
+		go func() {
+			errCh <- a.grpc.Serve(grpcListener)
+		}()
+	}
+	if a.internal != nil {
+		go func() {
+			errCh <- a.internal.Serve(internalListener)
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		a.log.Info("shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = a.echo.Shutdown(shutdownCtx)
+	case err = <-errCh:
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if shutdownErr := a.echo.Shutdown(shutdownCtx); shutdownErr != nil {
+			a.log.Error("cannot shut down HTTP server", zap.Error(shutdownErr))
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if a.grpc != nil {
+		stopGRPC(a.grpc)
+	}
+	if a.internal != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if shutdownErr := a.internal.Shutdown(shutdownCtx); shutdownErr != nil {
+			a.log.Error("cannot shut down internal server", zap.Error(shutdownErr))
+		}
+	}
+
+	stopDump()
+	wg.Wait()
+	if a.worker != nil {
+		if dumpErr := a.worker.Dump(); dumpErr != nil {
+			err = errors.Join(err, dumpErr)
+		}
+	}
+	if c, ok := a.st.(io.Closer); ok {
+		if closeErr := c.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+	}
+	return err
+}
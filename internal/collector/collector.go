@@ -0,0 +1,336 @@
+package collector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Config включает отдельные сборщики системных метрик.
+type Config struct {
+	ProcPath string
+	Memory   bool
+	CPU      bool
+	Disk     bool
+	Net      bool
+	Load     bool
+}
+
+type source struct {
+	name    string
+	collect func(values map[string]float64) error
+}
+
+// System собирает метрики хоста из /proc. Загрузка CPU считается по разнице
+// между двумя последовательными вызовами Collect, поэтому System хранит предыдущий замер.
+type System struct {
+	mu       sync.Mutex
+	procPath string
+	sources  []source
+	disabled map[string]bool
+	prevCPU  []cpuTimes
+}
+
+func NewSystem(cfg Config) *System {
+	s := &System{
+		procPath: cfg.ProcPath,
+		disabled: make(map[string]bool),
+	}
+	if s.procPath == "" {
+		s.procPath = "/proc"
+	}
+	if cfg.Memory {
+		s.sources = append(s.sources, source{name: "memory", collect: s.memory})
+	}
+	if cfg.CPU {
+		s.sources = append(s.sources, source{name: "cpu", collect: s.cpu})
+	}
+	if cfg.Disk {
+		s.sources = append(s.sources, source{name: "disk", collect: s.disk})
+	}
+	if cfg.Net {
+		s.sources = append(s.sources, source{name: "net", collect: s.net})
+	}
+	if cfg.Load {
+		s.sources = append(s.sources, source{name: "load", collect: s.load})
+	}
+	return s
+}
+
+// Collect возвращает значения всех включённых сборщиков. Ошибки отдельных сборщиков
+// объединяются в одну, остальные значения при этом возвращаются. Сборщик, файла которого
+// нет в системе, отключается после первой ошибки.
+func (s *System) Collect() (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[string]float64)
+	var errs []error
+	for _, src := range s.sources {
+		if s.disabled[src.name] {
+			continue
+		}
+		if err := src.collect(values); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				s.disabled[src.name] = true
+				err = fmt.Errorf("%w, collector disabled", err)
+			}
+			errs = append(errs, fmt.Errorf("%s collector: %w", src.name, err))
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+func (s *System) path(name string) string {
+	return filepath.Join(s.procPath, name)
+}
+
+// memory читает /proc/meminfo, значения там указаны в килобайтах.
+func (s *System) memory(values map[string]float64) error {
+	f, err := os.Open(s.path("meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	found := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var name string
+		switch fields[0] {
+		case "MemTotal:":
+			name = "TotalMemory"
+		case "MemFree:":
+			name = "FreeMemory"
+		default:
+			continue
+		}
+		kb, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("meminfo %s: %w", fields[0], err)
+		}
+		values[name] = kb * 1024
+		found++
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if found != 2 {
+		return errors.New("meminfo: MemTotal or MemFree not found")
+	}
+	return nil
+}
+
+type cpuTimes struct {
+	idle  float64
+	total float64
+}
+
+// cpu считает загрузку каждого ядра в процентах по строкам cpuN из /proc/stat.
+// При первом вызове загрузка считается от момента старта системы.
+func (s *System) cpu(values map[string]float64) error {
+	f, err := os.Open(s.path("stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	current := make([]cpuTimes, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			continue
+		}
+		var t cpuTimes
+		for i, field := range fields[1:] {
+			// guest и guest_nice уже учтены в user и nice
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return fmt.Errorf("stat %s: %w", fields[0], err)
+			}
+			t.total += v
+			// idle и iowait
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+		current = append(current, t)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return errors.New("stat: no per-cpu lines")
+	}
+
+	for i, t := range current {
+		idle, total := t.idle, t.total
+		if len(s.prevCPU) == len(current) {
+			idle -= s.prevCPU[i].idle
+			total -= s.prevCPU[i].total
+		}
+		utilization := 0.0
+		if total > 0 {
+			utilization = 100 * (total - idle) / total
+		}
+		values[fmt.Sprintf("CPUutilization%d", i+1)] = utilization
+	}
+	s.prevCPU = current
+	return nil
+}
+
+// load читает средние значения нагрузки из /proc/loadavg.
+func (s *System) load(values map[string]float64) error {
+	data, err := os.ReadFile(s.path("loadavg"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("loadavg: unexpected format %q", data)
+	}
+	names := []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"}
+	for i, name := range names {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("loadavg: %w", err)
+		}
+		values[name] = v
+	}
+	return nil
+}
+
+// net суммирует принятые и отправленные байты и пакеты всех интерфейсов, кроме lo, из /proc/net/dev.
+func (s *System) net(values map[string]float64) error {
+	f, err := os.Open(s.path("net/dev"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var recvBytes, recvPackets, sentBytes, sentPackets float64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		iface, stats, ok := strings.Cut(sc.Text(), ":")
+		if !ok || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(stats)
+		if len(fields) < 10 {
+			continue
+		}
+		parsed := make([]float64, 10)
+		for i := range parsed {
+			parsed[i], err = strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return fmt.Errorf("net/dev %s: %w", strings.TrimSpace(iface), err)
+			}
+		}
+		recvBytes += parsed[0]
+		recvPackets += parsed[1]
+		sentBytes += parsed[8]
+		sentPackets += parsed[9]
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	values["NetBytesRecv"] = recvBytes
+	values["NetPacketsRecv"] = recvPackets
+	values["NetBytesSent"] = sentBytes
+	values["NetPacketsSent"] = sentPackets
+	return nil
+}
+
+// sectorSize размер сектора в /proc/diskstats, он всегда 512 байт независимо от устройства.
+const sectorSize = 512
+
+// isPartition проверяет, что name раздел одного из устройств devices: имя устройства
+// с номером раздела (sda1) или, если имя устройства кончается цифрой, с p и номером
+// (nvme0n1p1, mmcblk0p2). Устройства вроде dm-10 или sdaa разделами dm-1 и sda не считаются.
+func isPartition(name string, devices []string) bool {
+	for _, dev := range devices {
+		suffix, ok := strings.CutPrefix(name, dev)
+		if !ok || suffix == "" {
+			continue
+		}
+		if last := dev[len(dev)-1]; last >= '0' && last <= '9' {
+			if suffix, ok = strings.CutPrefix(suffix, "p"); !ok {
+				continue
+			}
+		}
+		if suffix != "" && strings.Trim(suffix, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// disk суммирует прочитанные и записанные байты и число операций по дискам из /proc/diskstats.
+// Разделы, loop- и ram-устройства пропускаются, чтобы не считать одни и те же операции дважды.
+func (s *System) disk(values map[string]float64) error {
+	f, err := os.Open(s.path("diskstats"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	type diskLine struct {
+		name   string
+		fields []string
+	}
+	lines := make([]diskLine, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		lines = append(lines, diskLine{name: fields[2], fields: fields[3:]})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(lines))
+	for _, l := range lines {
+		names = append(names, l.name)
+	}
+
+	var reads, readBytes, writes, writeBytes float64
+	for _, l := range lines {
+		if strings.HasPrefix(l.name, "loop") || strings.HasPrefix(l.name, "ram") || isPartition(l.name, names) {
+			continue
+		}
+		// поля: reads completed, reads merged, sectors read, time reading, writes completed, writes merged, sectors written
+		parsed := make([]float64, 7)
+		for i := range parsed {
+			parsed[i], err = strconv.ParseFloat(l.fields[i], 64)
+			if err != nil {
+				return fmt.Errorf("diskstats %s: %w", l.name, err)
+			}
+		}
+		reads += parsed[0]
+		readBytes += parsed[2] * sectorSize
+		writes += parsed[4]
+		writeBytes += parsed[6] * sectorSize
+	}
+	values["DiskReads"] = reads
+	values["DiskReadBytes"] = readBytes
+	values["DiskWrites"] = writes
+	values["DiskWriteBytes"] = writeBytes
+	return nil
+}
@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func allEnabled(procPath string) Config {
+	return Config{ProcPath: procPath, Memory: true, CPU: true, Disk: true, Net: true, Load: true}
+}
+
+func TestCollect(t *testing.T) {
+	s := NewSystem(allEnabled("testdata/proc"))
+	values, err := s.Collect()
+	require.NoError(t, err)
+
+	want := map[string]float64{
+		"TotalMemory":     8048576 * 1024,
+		"FreeMemory":      2097152 * 1024,
+		"CPUutilization1": 15,
+		"LoadAverage1":    0.52,
+		"LoadAverage5":    0.34,
+		"LoadAverage15":   0.18,
+		"NetBytesRecv":    1250000,
+		"NetPacketsRecv":  12500,
+		"NetBytesSent":    2125000,
+		"NetPacketsSent":  16250,
+		"DiskReads":       1500,
+		"DiskReadBytes":   30000 * 512,
+		"DiskWrites":      2300,
+		"DiskWriteBytes":  46000 * 512,
+	}
+	for name, v := range want {
+		assert.InDelta(t, v, values[name], 1e-9, name)
+	}
+	assert.InDelta(t, 100.0/6, values["CPUutilization2"], 1e-9)
+	assert.NotContains(t, values, "CPUutilization3")
+}
+
+func TestIsPartition(t *testing.T) {
+	devices := []string{"sda", "sda1", "sdaa", "nvme0n1", "nvme0n1p1", "nvme0n10", "dm-1", "dm-10", "mmcblk0", "mmcblk0p2", "md127"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "sda", want: false},
+		{name: "sda1", want: true},
+		{name: "sdaa", want: false},
+		{name: "nvme0n1", want: false},
+		{name: "nvme0n1p1", want: true},
+		{name: "nvme0n10", want: false},
+		{name: "dm-1", want: false},
+		{name: "dm-10", want: false},
+		{name: "mmcblk0", want: false},
+		{name: "mmcblk0p2", want: true},
+		{name: "md127", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isPartition(tt.name, devices))
+		})
+	}
+}
+
+func TestCPUUtilizationUsesDelta(t *testing.T) {
+	s := NewSystem(Config{ProcPath: "testdata/proc", CPU: true})
+	_, err := s.Collect()
+	require.NoError(t, err)
+
+	s.procPath = "testdata/proc-next"
+	values, err := s.Collect()
+	require.NoError(t, err)
+	assert.InDelta(t, 100.0*2/3, values["CPUutilization1"], 1e-9)
+	assert.InDelta(t, 100.0, values["CPUutilization2"], 1e-9)
+}
+
+func TestCollectorsAreSwitchable(t *testing.T) {
+	s := NewSystem(Config{ProcPath: "testdata/proc", Memory: true})
+	values, err := s.Collect()
+	require.NoError(t, err)
+	assert.Len(t, values, 2)
+	assert.Contains(t, values, "TotalMemory")
+	assert.Contains(t, values, "FreeMemory")
+}
+
+func TestMissingSourceIsDisabled(t *testing.T) {
+	s := NewSystem(allEnabled("testdata/missing"))
+	values, err := s.Collect()
+	assert.Error(t, err)
+	assert.Empty(t, values)
+
+	_, err = s.Collect()
+	assert.NoError(t, err, "collectors without a source file must be disabled after the first failure")
+}
@@ -4,7 +4,8 @@ import (
 	"flag"
 	"github.com/caarlos0/env"
 	"github.com/lionslon/go-yapmetrics/internal/storage"
-	"go.uber.org/zap"
+	"log"
+	"time"
 )
 
 type ClientConfig struct {
@@ -12,15 +13,45 @@ type ClientConfig struct {
 	ReportInterval int    `env:"REPORT_INTERVAL"`
 	Addr           string `env:"ADDRESS"`
 	SignPass       string `env:"KEY"`
+	BatchSize      int    `env:"BATCH_SIZE"`
+	RateLimit      int    `env:"RATE_LIMIT"`
+	ProcPath       string `env:"PROC_PATH"`
+	CollectMemory  bool   `env:"COLLECT_MEMORY"`
+	CollectCPU     bool   `env:"COLLECT_CPU"`
+	CollectDisk    bool   `env:"COLLECT_DISK"`
+	CollectNet     bool   `env:"COLLECT_NET"`
+	CollectLoad    bool   `env:"COLLECT_LOAD"`
+	CryptoKey      string `env:"CRYPTO_KEY"`
+	Transport      string `env:"TRANSPORT"`
+	GRPCAddr       string `env:"GRPC_ADDRESS"`
+	Instance       string `env:"INSTANCE"`
+	LogLevel       string `env:"LOG_LEVEL"`
+	LogFormat      string `env:"LOG_FORMAT"`
 }
 
 type ServerConfig struct {
-	Addr          string `env:"ADDRESS"`
-	StoreInterval int    `env:"STORE_INTERVAL"`
-	FilePath      string `env:"FILE_STORAGE_PATH"`
-	Restore       bool   `env:"RESTORE"`
-	DatabaseDSN   string `env:"DATABASE_DSN"`
-	SignPass      string `env:"KEY"`
+	Addr             string `env:"ADDRESS"`
+	StoreInterval    int    `env:"STORE_INTERVAL"`
+	FilePath         string `env:"FILE_STORAGE_PATH"`
+	Restore          bool   `env:"RESTORE"`
+	Journal          bool   `env:"FILE_JOURNAL"`
+	DatabaseDSN      string `env:"DATABASE_DSN"`
+	SignPass         string `env:"KEY"`
+	CryptoKey        string `env:"CRYPTO_KEY"`
+	TrustedSubnet    string `env:"TRUSTED_SUBNET"`
+	OpenReads        bool   `env:"OPEN_READS"`
+	GRPCAddr         string `env:"GRPC_ADDRESS"`
+	HistorySize      int    `env:"HISTORY_SIZE"`
+	HistoryRetention int    `env:"HISTORY_RETENTION"`
+	AlertRules       string `env:"ALERT_RULES"`
+	AlertWebhook     string `env:"ALERT_WEBHOOK"`
+	AlertInterval    int    `env:"ALERT_INTERVAL"`
+	MetricTTL        int    `env:"METRIC_TTL"`
+	ExpireStale      bool   `env:"EXPIRE_STALE"`
+	LogLevel         string `env:"LOG_LEVEL"`
+	LogFormat        string `env:"LOG_FORMAT"`
+	InternalAddr     string `env:"INTERNAL_ADDRESS"`
+	SelfMetrics      int    `env:"SELF_METRICS_INTERVAL"`
 }
 
 func NewClient() *ClientConfig {
@@ -29,7 +60,10 @@ func NewClient() *ClientConfig {
 	err := env.Parse(cfg)
 
 	if err != nil {
-		zap.S().Error(err)
+		log.Println(err)
+	}
+	if cfg.RateLimit < 1 {
+		cfg.RateLimit = 1
 	}
 	return cfg
 }
@@ -39,6 +73,20 @@ func parseClientFlags(c *ClientConfig) {
 	flag.IntVar(&c.ReportInterval, "r", 10, "report interval in seconds")
 	flag.IntVar(&c.PollInterval, "p", 2, "poll interval in seconds")
 	flag.StringVar(&c.SignPass, "k", "", "signature for HashSHA256")
+	flag.IntVar(&c.BatchSize, "b", 64*1024, "max size in bytes of one /updates/ payload before compression")
+	flag.IntVar(&c.RateLimit, "l", 1, "max number of concurrent outgoing requests")
+	flag.StringVar(&c.ProcPath, "proc", "/proc", "path to procfs for host metrics")
+	flag.BoolVar(&c.CollectMemory, "collect-mem", true, "collect TotalMemory and FreeMemory")
+	flag.BoolVar(&c.CollectCPU, "collect-cpu", true, "collect per-core CPUutilization")
+	flag.BoolVar(&c.CollectDisk, "collect-disk", true, "collect disk I/O metrics")
+	flag.BoolVar(&c.CollectNet, "collect-net", true, "collect network I/O metrics")
+	flag.BoolVar(&c.CollectLoad, "collect-load", true, "collect load average metrics")
+	flag.StringVar(&c.CryptoKey, "crypto-key", "", "path to the server public key for encrypting requests")
+	flag.StringVar(&c.Transport, "transport", "http", "how to send metrics: http or grpc")
+	flag.StringVar(&c.GRPCAddr, "g", "", "address and port of the server gRPC API, required with -transport=grpc")
+	flag.StringVar(&c.Instance, "instance", "", "value of the instance label, the hostname by default; set it when several agents run on one host")
+	flag.StringVar(&c.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&c.LogFormat, "log-format", "json", "log format: json or console")
 	flag.Parse()
 }
 
@@ -48,18 +96,34 @@ func NewServer() *ServerConfig {
 	err := env.Parse(cfg)
 
 	if err != nil {
-		zap.S().Error(err)
+		log.Println(err)
 	}
 	return cfg
 }
 
 func parseServerFlags(s *ServerConfig) {
 	flag.StringVar(&s.Addr, "a", "localhost:8080", "address and port to run server")
-	flag.IntVar(&s.StoreInterval, "i", 300, "interval for saving metrics on the server")
+	flag.IntVar(&s.StoreInterval, "i", 300, "interval in seconds for saving metrics on the server, 0 saves every update through the journal")
 	flag.StringVar(&s.FilePath, "f", "/tmp/metrics-db.json", "file storage path for saving data")
 	flag.BoolVar(&s.Restore, "r", true, "need to load data at startup")
+	flag.BoolVar(&s.Journal, "j", false, "write every update to an append-only journal next to the storage file, always on with -i 0")
 	flag.StringVar(&s.DatabaseDSN, "d", "", "Database Data Source Name")
 	flag.StringVar(&s.SignPass, "k", "", "signature for HashSHA256")
+	flag.StringVar(&s.CryptoKey, "crypto-key", "", "path to the private key for decrypting requests")
+	flag.StringVar(&s.TrustedSubnet, "t", "", "CIDR of agents allowed to send metrics, checked against X-Real-IP")
+	flag.BoolVar(&s.OpenReads, "open-reads", false, "do not apply the trusted subnet check to read-only endpoints")
+	flag.StringVar(&s.GRPCAddr, "g", "", "address and port to run gRPC server, empty to disable it")
+	flag.IntVar(&s.HistorySize, "history-size", storage.DefaultHistory.Size, "how many recent samples to keep per series, 0 disables history and rollups")
+	flag.IntVar(&s.HistoryRetention, "history-retention", int(storage.DefaultHistory.Retention.Seconds()), "max age of history samples in seconds, 0 for no limit")
+	flag.StringVar(&s.AlertRules, "alert-rules", "", "path to a YAML or JSON file with alerting rules, empty to disable alerting")
+	flag.StringVar(&s.AlertWebhook, "alert-webhook", "", "URL that receives firing and resolved alerts")
+	flag.IntVar(&s.AlertInterval, "alert-interval", 10, "alerting rules evaluation interval in seconds")
+	flag.IntVar(&s.MetricTTL, "metric-ttl", 0, "seconds without updates after which a series is stale, 0 disables staleness")
+	flag.BoolVar(&s.ExpireStale, "expire-stale", false, "delete series once they are stale instead of only marking them")
+	flag.StringVar(&s.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&s.LogFormat, "log-format", "json", "log format: json or console")
+	flag.StringVar(&s.InternalAddr, "internal-addr", "", "address and port of the internal endpoint with the server's own metrics, empty to disable it")
+	flag.IntVar(&s.SelfMetrics, "self-metrics-interval", 0, "how often in seconds to write the server's own metrics into its storage, 0 disables it")
 
 	flag.Parse()
 }
@@ -68,6 +132,18 @@ func (s *ServerConfig) StoreIntervalNotZero() bool {
 	return s.StoreInterval != 0
 }
 
+func (s *ServerConfig) History() storage.HistoryConfig {
+	return storage.HistoryConfig{
+		Size:      s.HistorySize,
+		Retention: time.Duration(s.HistoryRetention) * time.Second,
+		Rollups:   storage.DefaultRollups,
+	}
+}
+
+func (s *ServerConfig) TTL() time.Duration {
+	return time.Duration(s.MetricTTL) * time.Second
+}
+
 func (s *ServerConfig) GetProvider() storage.StorageProvider {
 	if s.DatabaseDSN != "" {
 		return storage.DBProvider
@@ -0,0 +1,173 @@
+// Package encryption шифрует тела запросов агента открытым ключом RSA сервера.
+//
+// Шифрование гибридное: тело шифруется AES-256-GCM случайным ключом, а сам ключ
+// шифруется RSA-OAEP с SHA-256. RSA-OAEP ограничивает размер открытого текста
+// несколькими сотнями байт, поэтому напрямую пакеты метрик им не зашифровать.
+//
+// Формат сообщения: длина зашифрованного ключа (2 байта, big endian),
+// зашифрованный ключ, nonce GCM, шифротекст с тегом аутентификации.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header заголовок, которым агент помечает зашифрованное тело запроса.
+const Header = "X-Encrypted"
+
+// Scheme значение заголовка Header для схемы RSA-OAEP + AES-GCM.
+const Scheme = "rsa-oaep-aes-gcm"
+
+const aesKeySize = 32
+
+var ErrMalformed = errors.New("malformed encrypted message")
+
+// Encrypt шифрует data открытым ключом pub.
+func Encrypt(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 2, 2+len(wrapped)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+// Decrypt расшифровывает сообщение, созданное Encrypt, закрытым ключом priv.
+func Decrypt(priv *rsa.PrivateKey, msg []byte) ([]byte, error) {
+	if len(msg) < 2 {
+		return nil, ErrMalformed
+	}
+	keyLen := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	if len(msg) < keyLen {
+		return nil, ErrMalformed
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, msg[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt key: %w", err)
+	}
+	msg = msg[keyLen:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	data, err := gcm.Open([]byte{}, msg[:gcm.NonceSize()], msg[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt body: %w", err)
+	}
+	return data, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKeys создаёт пару ключей RSA и возвращает их в PEM:
+// закрытый в PKCS #8, открытый в PKIX.
+func GenerateKeys(bits int) (privPEM []byte, pubPEM []byte, err error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return privPEM, pubPEM, nil
+}
+
+// ParsePublicKey разбирает открытый ключ в PEM (PKIX или PKCS #1).
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key: no PEM block found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key: %T is not an RSA key", key)
+	}
+	return pub, nil
+}
+
+// ParsePrivateKey разбирает закрытый ключ в PEM (PKCS #8 или PKCS #1).
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key: no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key: %T is not an RSA key", key)
+	}
+	return priv, nil
+}
+
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(data)
+}
+
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data)
+}
@@ -0,0 +1,67 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generate(t *testing.T) (*rsa.PrivateKey, *rsa.PublicKey) {
+	t.Helper()
+	privPEM, pubPEM, err := GenerateKeys(2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "private.pem"), privPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "public.pem"), pubPEM, 0644))
+	priv, err := LoadPrivateKey(filepath.Join(dir, "private.pem"))
+	require.NoError(t, err)
+	pub, err := LoadPublicKey(filepath.Join(dir, "public.pem"))
+	require.NoError(t, err)
+	return priv, pub
+}
+
+func TestRoundTrip(t *testing.T) {
+	priv, pub := generate(t)
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "small", data: []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)},
+		{name: "larger than RSA block", data: bytes.Repeat([]byte("metrics"), 64*1024)},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := Encrypt(pub, test.data)
+			require.NoError(t, err)
+			got, err := Decrypt(priv, msg)
+			require.NoError(t, err)
+			assert.Equal(t, test.data, got)
+		})
+	}
+}
+
+func TestDecryptRejectsTamperedMessage(t *testing.T) {
+	priv, pub := generate(t)
+	msg, err := Encrypt(pub, []byte("payload"))
+	require.NoError(t, err)
+
+	tampered := bytes.Clone(msg)
+	tampered[len(tampered)-1] ^= 1
+	_, err = Decrypt(priv, tampered)
+	assert.Error(t, err)
+
+	_, err = Decrypt(priv, msg[:10])
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	other, _ := generate(t)
+	_, err = Decrypt(other, msg)
+	assert.Error(t, err)
+}
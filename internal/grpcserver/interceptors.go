@@ -0,0 +1,116 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/middlewares"
+	"github.com/lionslon/go-yapmetrics/internal/pb"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// requestIDKey ключ метаданных с идентификатором запроса, аналог заголовка X-Request-ID.
+var requestIDKey = strings.ToLower(logger.RequestIDHeader)
+
+// requestID берёт идентификатор запроса из метаданных или создаёт новый, возвращает его
+// в заголовочных метаданных ответа и кладёт в context логгер log с полем request_id,
+// как middlewares.RequestID.
+func requestID(log *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id := firstMetadata(ctx, requestIDKey)
+		if !logger.ValidRequestID(id) {
+			id = logger.NewRequestID()
+		}
+		ctx = logger.WithRequestID(logger.WithContext(ctx, log), id)
+		if err := grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id)); err != nil {
+			logger.FromContext(ctx).Error("cannot set request id header", zap.Error(err))
+		}
+		return handler(ctx, req)
+	}
+}
+
+// instrument учитывает вызов в метриках сервера m и кладёт m в context, как middlewares.Instrument.
+func instrument(m *selfmetrics.Metrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(selfmetrics.WithContext(ctx, m), req)
+		m.ObserveRequest("grpc", info.FullMethod, "", status.Code(err).String(), time.Since(start))
+		return resp, err
+	}
+}
+
+// logging пишет в лог метод, длительность и код ответа, как middlewares.WithLogging.
+func logging(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logger.FromContext(ctx).Info("request",
+		zap.String("method", info.FullMethod),
+		zap.String("code", status.Code(err).String()),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return resp, err
+}
+
+// readMethods методы, которые при OpenReads доступны вне доверенной подсети.
+var readMethods = map[string]bool{
+	pb.Metrics_GetValue_FullMethodName: true,
+	pb.Metrics_List_FullMethodName:     true,
+}
+
+// trustedSubnet проверяет адрес из метаданных x-real-ip, как middlewares.TrustedSubnet.
+func trustedSubnet(subnet *net.IPNet, openReads bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if openReads && readMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		if !middlewares.InSubnet(subnet, firstMetadata(ctx, pb.RealIPHeader)) {
+			return nil, status.Error(codes.PermissionDenied, "address is not in the trusted subnet")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// sign проверяет подпись запроса и подписывает ответ в заголовочных метаданных.
+func sign(password string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		msg, ok := req.(proto.Message)
+		if !ok || !pb.ValidSign(msg, password, firstMetadata(ctx, pb.SignHeader)) {
+			selfmetrics.FromContext(ctx).SignatureFailure("grpc")
+			return nil, status.Error(codes.Unauthenticated, "signature is not valid")
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		if msg, ok := resp.(proto.Message); ok {
+			signature, signErr := pb.Sign(msg, password)
+			if signErr != nil {
+				return nil, status.Error(codes.Internal, signErr.Error())
+			}
+			if err := grpc.SetHeader(ctx, metadata.Pairs(pb.SignHeader, signature)); err != nil {
+				logger.FromContext(ctx).Error("cannot set signature header", zap.Error(err))
+			}
+		}
+		return resp, nil
+	}
+}
+
+func firstMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
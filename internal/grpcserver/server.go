@@ -0,0 +1,129 @@
+// Package grpcserver обслуживает gRPC-сервис метрик поверх того же хранилища, что и HTTP API.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/pb"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Config включает перехватчики, повторяющие middleware HTTP API. Logger получает
+// строки лога запросов, nil отключает лог. Metrics учитывает вызовы в метриках сервера.
+type Config struct {
+	SignPass      string
+	TrustedSubnet *net.IPNet
+	OpenReads     bool
+	Logger        *zap.Logger
+	Metrics       *selfmetrics.Metrics
+}
+
+type server struct {
+	pb.UnimplementedMetricsServer
+	store storage.MetricsStore
+}
+
+func New(store storage.MetricsStore, cfg Config) *grpc.Server {
+	log := cfg.Logger
+	if log == nil {
+		log = zap.NewNop()
+	}
+	interceptors := []grpc.UnaryServerInterceptor{requestID(log), instrument(cfg.Metrics), logging}
+	if cfg.TrustedSubnet != nil {
+		interceptors = append(interceptors, trustedSubnet(cfg.TrustedSubnet, cfg.OpenReads))
+	}
+	if cfg.SignPass != "" {
+		interceptors = append(interceptors, sign(cfg.SignPass))
+	}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+	pb.RegisterMetricsServer(s, &server{store: store})
+	return s
+}
+
+// storeError переводит ошибку хранилища в статус gRPC: NotFound для неизвестной метрики, Internal для остальных.
+func storeError(ctx context.Context, err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return status.Error(codes.NotFound, "metric not found")
+	}
+	logger.FromContext(ctx).Error("storage error", zap.Error(err))
+	return status.Error(codes.Internal, "storage error")
+}
+
+func (s *server) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	metric := req.GetMetric().Model()
+	if err := metric.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var err error
+	switch metric.MType {
+	case "counter":
+		err = s.store.UpdateCounter(ctx, metric.Key(), *metric.Delta)
+	case "gauge":
+		err = s.store.UpdateGauge(ctx, metric.Key(), *metric.Value)
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return &pb.UpdateResponse{Metric: pb.FromModel(metric)}, nil
+}
+
+func (s *server) Updates(ctx context.Context, req *pb.UpdatesRequest) (*pb.UpdatesResponse, error) {
+	metrics := pb.ToModels(req.GetMetrics())
+	err := s.store.StoreBatch(ctx, metrics)
+	var batchErr *storage.BatchError
+	if errors.As(err, &batchErr) {
+		st, detailsErr := status.New(codes.InvalidArgument, "batch rejected").
+			WithDetails(&pb.UpdatesResponse{Errors: pb.FromBatchErrors(batchErr.Items)})
+		if detailsErr != nil {
+			return nil, status.Error(codes.InvalidArgument, batchErr.Error())
+		}
+		return nil, st.Err()
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return &pb.UpdatesResponse{Applied: int32(len(metrics))}, nil
+}
+
+func (s *server) GetValue(ctx context.Context, req *pb.GetValueRequest) (*pb.GetValueResponse, error) {
+	metric := &pb.Metric{Id: req.GetId(), Type: req.GetType(), Labels: req.GetLabels()}
+	if err := models.ValidateLabels(req.GetLabels()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	key := models.SeriesKey(req.GetId(), req.GetLabels())
+	switch req.GetType() {
+	case "counter":
+		v, err := s.store.GetCounterValue(ctx, key)
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		metric.Delta = &v
+	case "gauge":
+		v, err := s.store.GetGaugeValue(ctx, key)
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		metric.Value = &v
+	default:
+		return nil, status.Error(codes.NotFound, "invalid metric type, can only be 'gauge' or 'counter'")
+	}
+	return &pb.GetValueResponse{Metric: metric}, nil
+}
+
+func (s *server) List(ctx context.Context, _ *pb.ListRequest) (*pb.ListResponse, error) {
+	metrics, err := s.store.List(ctx)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return &pb.ListResponse{Metrics: pb.FromModels(metrics)}, nil
+}
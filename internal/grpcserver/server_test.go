@@ -0,0 +1,162 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lionslon/go-yapmetrics/internal/pb"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient поднимает сервер на bufconn и возвращает клиента к нему.
+func newTestClient(t *testing.T, cfg Config) (pb.MetricsClient, *storage.MemStorage) {
+	st := storage.NewMem()
+	lis := bufconn.Listen(1 << 20)
+	srv := New(st, cfg)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn), st
+}
+
+func TestUpdateAndGetValue(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	delta := int64(5)
+	_, err := client.Update(ctx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}})
+	require.NoError(t, err)
+	_, err = client.Update(ctx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "PollCount", Type: "counter", Delta: &delta}})
+	require.NoError(t, err)
+
+	resp, err := client.GetValue(ctx, &pb.GetValueRequest{Id: "PollCount", Type: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), resp.GetMetric().GetDelta())
+
+	_, err = client.GetValue(ctx, &pb.GetValueRequest{Id: "Unknown", Type: "gauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.Update(ctx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "Alloc", Type: "gauge"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestLabeledSeries(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	a, b := 1.5, 2.5
+	_, err := client.Update(ctx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "Alloc", Type: "gauge", Value: &a, Labels: map[string]string{"host": "a"}}})
+	require.NoError(t, err)
+	_, err = client.Update(ctx, &pb.UpdateRequest{Metric: &pb.Metric{Id: "Alloc", Type: "gauge", Value: &b, Labels: map[string]string{"host": "b"}}})
+	require.NoError(t, err)
+
+	resp, err := client.GetValue(ctx, &pb.GetValueRequest{Id: "Alloc", Type: "gauge", Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	assert.Equal(t, a, resp.GetMetric().GetValue())
+
+	_, err = client.GetValue(ctx, &pb.GetValueRequest{Id: "Alloc", Type: "gauge"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.List(ctx, &pb.ListRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 2)
+	assert.Equal(t, map[string]string{"host": "b"}, list.GetMetrics()[1].GetLabels())
+}
+
+func TestUpdatesAndList(t *testing.T) {
+	client, _ := newTestClient(t, Config{})
+	ctx := context.Background()
+
+	value, delta := 1.5, int64(2)
+	resp, err := client.Updates(ctx, &pb.UpdatesRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: "gauge", Value: &value},
+		{Id: "PollCount", Type: "counter", Delta: &delta},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), resp.GetApplied())
+
+	list, err := client.List(ctx, &pb.ListRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetMetrics(), 2)
+	assert.Equal(t, "Alloc", list.GetMetrics()[0].GetId())
+
+	_, err = client.Updates(ctx, &pb.UpdatesRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: "gauge", Value: &value},
+		{Id: "Broken", Type: "gauge"},
+	}})
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	result := st.Details()[0].(*pb.UpdatesResponse)
+	require.Len(t, result.GetErrors(), 1)
+	assert.Equal(t, int32(1), result.GetErrors()[0].GetIndex())
+}
+
+func TestSignInterceptor(t *testing.T) {
+	client, _ := newTestClient(t, Config{SignPass: "secret"})
+	ctx := context.Background()
+	req := &pb.ListRequest{}
+
+	_, err := client.List(ctx, req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	signature, err := pb.Sign(req, "secret")
+	require.NoError(t, err)
+	var header metadata.MD
+	resp, err := client.List(metadata.AppendToOutgoingContext(ctx, pb.SignHeader, signature), req, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, header.Get(pb.SignHeader), 1)
+	assert.True(t, pb.ValidSign(resp, "secret", header.Get(pb.SignHeader)[0]))
+}
+
+func TestInstrumentInterceptor(t *testing.T) {
+	m := selfmetrics.New(storage.NewMem())
+	client, _ := newTestClient(t, Config{SignPass: "secret", Metrics: m})
+	_, err := client.List(context.Background(), &pb.ListRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `yapmetrics_requests_total{route="`+pb.Metrics_List_FullMethodName+`",status="Unauthenticated",transport="grpc"} 1`)
+	assert.Contains(t, rec.Body.String(), `yapmetrics_signature_failures_total{transport="grpc"} 1`)
+}
+
+func TestTrustedSubnetInterceptor(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	ctx := context.Background()
+	value := 1.0
+	update := &pb.UpdateRequest{Metric: &pb.Metric{Id: "Alloc", Type: "gauge", Value: &value}}
+
+	client, _ := newTestClient(t, Config{TrustedSubnet: subnet, OpenReads: true})
+	_, err = client.Update(metadata.AppendToOutgoingContext(ctx, pb.RealIPHeader, "192.168.0.1"), update)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Update(metadata.AppendToOutgoingContext(ctx, pb.RealIPHeader, "10.0.0.1"), update)
+	assert.NoError(t, err)
+	_, err = client.List(ctx, &pb.ListRequest{})
+	assert.NoError(t, err, "reads must stay open")
+
+	client, _ = newTestClient(t, Config{TrustedSubnet: subnet})
+	_, err = client.List(ctx, &pb.ListRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
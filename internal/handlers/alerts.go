@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/alerts"
+)
+
+// Alerts отдаёт текущие оповещения движка правил. Если правила не заданы, engine равен nil
+// и отдаётся пустой список.
+func (h *handler) Alerts(engine *alerts.Engine) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		list := make([]alerts.Alert, 0)
+		if engine != nil {
+			list = engine.Alerts()
+		}
+		return ctx.JSON(http.StatusOK, list)
+	}
+}
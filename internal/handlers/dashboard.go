@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+)
+
+//go:embed templates/dashboard.html
+var templatesFS embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(templatesFS, "templates/dashboard.html"))
+
+type dashboardRow struct {
+	Name    string
+	Labels  string
+	Value   string
+	Updated string
+	Stale   bool
+}
+
+type dashboardTable struct {
+	Title string
+	Rows  []dashboardRow
+}
+
+type dashboardPage struct {
+	Filter         string
+	Sort           string
+	Order          string
+	Tables         []dashboardTable
+	NameSortURL    string
+	UpdatedSortURL string
+}
+
+// AllMetricsValues отдаёт страницу со всеми метриками. Параметры запроса: name фильтрует
+// по подстроке имени без учёта регистра, sort=name|updated и order=asc|desc задают порядок строк.
+// Прежний текстовый вывод доступен по ?format=text или с заголовком Accept: text/plain,
+// список в JSON со временем обновления серий по ?format=json или с Accept: application/json.
+// Серии, которые не обновлялись дольше TTL хранилища, отмечаются как устаревшие.
+func (h *handler) AllMetricsValues() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		metrics, err := h.store.List(ctx.Request().Context())
+		if err != nil {
+			return storeError(ctx, err)
+		}
+
+		filter := ctx.QueryParam("name")
+		metrics = filterMetrics(metrics, filter)
+
+		switch outputFormat(ctx.Request()) {
+		case "text":
+			return ctx.Blob(http.StatusOK, "text/plain; charset=utf-8", []byte(metricsText(metrics)))
+		case "json":
+			return ctx.JSON(http.StatusOK, metricsJSON(metrics))
+		}
+
+		sortBy := ctx.QueryParam("sort")
+		if sortBy != "updated" {
+			sortBy = "name"
+		}
+		order := ctx.QueryParam("order")
+		if order != "desc" {
+			order = "asc"
+		}
+		sortDashboard(metrics, sortBy, order == "desc")
+
+		page := dashboardPage{
+			Filter:         filter,
+			Sort:           sortBy,
+			Order:          order,
+			Tables:         dashboardTables(metrics),
+			NameSortURL:    sortURL(filter, "name", sortBy, order),
+			UpdatedSortURL: sortURL(filter, "updated", sortBy, order),
+		}
+		var buf bytes.Buffer
+		if err := dashboardTemplate.Execute(&buf, page); err != nil {
+			return err
+		}
+		return ctx.HTMLBlob(http.StatusOK, buf.Bytes())
+	}
+}
+
+// outputFormat выбирает формат ответа: параметр format, иначе text или json, если клиент
+// принимает text/plain или application/json, но не text/html. По умолчанию html.
+func outputFormat(req *http.Request) string {
+	if format := req.URL.Query().Get("format"); format != "" {
+		if format == "text" || format == "json" {
+			return format
+		}
+		return "html"
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return "html"
+	case strings.Contains(accept, "text/plain"):
+		return "text"
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	}
+	return "html"
+}
+
+// metricStatus элемент JSON-вывода: метрика вместе со временем последнего обновления.
+type metricStatus struct {
+	models.Metrics
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func metricsJSON(metrics []models.Metrics) []metricStatus {
+	result := make([]metricStatus, 0, len(metrics))
+	for _, m := range metrics {
+		st := metricStatus{Metrics: m}
+		if !m.UpdatedAt.IsZero() {
+			updated := m.UpdatedAt
+			st.UpdatedAt = &updated
+		}
+		result = append(result, st)
+	}
+	return result
+}
+
+func filterMetrics(metrics []models.Metrics, filter string) []models.Metrics {
+	if filter == "" {
+		return metrics
+	}
+	filter = strings.ToLower(filter)
+	result := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if strings.Contains(strings.ToLower(m.ID), filter) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func sortDashboard(metrics []models.Metrics, sortBy string, desc bool) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		if desc {
+			a, b = b, a
+		}
+		if sortBy == "updated" && !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.Before(b.UpdatedAt)
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Key() < b.Key()
+	})
+}
+
+// sortURL ссылка для заголовка столбца: повторный щелчок по текущему столбцу меняет направление.
+func sortURL(filter, column, sortBy, order string) string {
+	nextOrder := "asc"
+	if column == sortBy && order == "asc" {
+		nextOrder = "desc"
+	}
+	q := url.Values{}
+	if filter != "" {
+		q.Set("name", filter)
+	}
+	q.Set("sort", column)
+	q.Set("order", nextOrder)
+	return "/?" + q.Encode()
+}
+
+func dashboardTables(metrics []models.Metrics) []dashboardTable {
+	gauges := dashboardTable{Title: "Gauge metrics", Rows: make([]dashboardRow, 0)}
+	counters := dashboardTable{Title: "Counter metrics", Rows: make([]dashboardRow, 0)}
+	for _, m := range metrics {
+		row := dashboardRow{Name: m.ID, Labels: labelsText(m.Labels), Updated: formatUpdated(m.UpdatedAt), Stale: m.Stale}
+		switch m.MType {
+		case "gauge":
+			row.Value = fmt.Sprint(*m.Value)
+			gauges.Rows = append(gauges.Rows, row)
+		case "counter":
+			row.Value = fmt.Sprint(*m.Delta)
+			counters.Rows = append(counters.Rows, row)
+		}
+	}
+	return []dashboardTable{gauges, counters}
+}
+
+// labelsText метки серии в виде host=web-1, instance=web-1:8042.
+func labelsText(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func formatUpdated(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+	return t.Local().Format("2006-01-02 15:04:05 MST")
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// deleteResult ответ DELETE /values/.
+type deleteResult struct {
+	Deleted int `json:"deleted"`
+}
+
+// DeleteMetric удаляет серию вместе с историей: DELETE /value/gauge/Alloc?host=web-1.
+func (h *handler) DeleteMetric() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		typeM := ctx.Param("typeM")
+		if typeM != "counter" && typeM != "gauge" {
+			return ctx.String(http.StatusNotFound, "Invalid metric type. Can only be 'gauge' or 'counter'")
+		}
+		key, err := seriesKey(ctx.Param("nameM"), queryLabels(ctx))
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+		if err := h.store.Delete(ctx.Request().Context(), typeM, key); err != nil {
+			return storeError(ctx, err)
+		}
+		return ctx.String(http.StatusOK, "")
+	}
+}
+
+// DeleteByPrefix удаляет серии обоих типов с любыми метками, имя которых начинается
+// с prefix: DELETE /values/?prefix=Test. Пустой префикс не принимается.
+func (h *handler) DeleteByPrefix() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		prefix := ctx.QueryParam("prefix")
+		if prefix == "" {
+			return ctx.String(http.StatusBadRequest, "prefix is required")
+		}
+		if strings.ContainsAny(prefix, "{}") {
+			return ctx.String(http.StatusBadRequest, "prefix must not contain '{' or '}'")
+		}
+		n, err := h.store.DeletePrefix(ctx.Request().Context(), prefix)
+		if err != nil {
+			return storeError(ctx, err)
+		}
+		return ctx.JSON(http.StatusOK, deleteResult{Deleted: n})
+	}
+}
+
+// ResetCounter обнуляет счётчик: POST /reset/counter/PollCount?host=web-1.
+func (h *handler) ResetCounter() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		key, err := seriesKey(ctx.Param("nameM"), queryLabels(ctx))
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+		if err := h.store.ResetCounter(ctx.Request().Context(), key); err != nil {
+			return storeError(ctx, err)
+		}
+		return ctx.String(http.StatusOK, "")
+	}
+}
@@ -1,8 +1,449 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWebhook(t *testing.T) {
 }
+
+func TestUpdatesJSON(t *testing.T) {
+	testCases := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantResult models.BatchResult
+		wantPoll   int64
+	}{
+		{
+			name:       "valid batch",
+			body:       `[{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge","value":1.5}]`,
+			wantStatus: http.StatusOK,
+			wantResult: models.BatchResult{Applied: 2},
+			wantPoll:   3,
+		},
+		{
+			name:       "invalid items reject the whole batch",
+			body:       `[{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge"},{"id":"x","type":"summary","value":1}]`,
+			wantStatus: http.StatusBadRequest,
+			wantResult: models.BatchResult{Errors: []models.BatchItemError{
+				{Index: 1, ID: "Alloc", Reason: "gauge without value"},
+				{Index: 2, ID: "x", Reason: "invalid metric type, can only be 'gauge' or 'counter'"},
+			}},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			st := storage.NewMem()
+			h := New(st)
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(test.body))
+			rec := httptest.NewRecorder()
+
+			require.NoError(t, h.UpdatesJSON()(e.NewContext(req, rec)))
+			assert.Equal(t, test.wantStatus, rec.Code)
+
+			var result models.BatchResult
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+			assert.Equal(t, test.wantResult, result)
+
+			poll, _ := st.GetCounterValue(context.Background(), "PollCount")
+			assert.Equal(t, test.wantPoll, poll)
+		})
+	}
+}
+
+func TestUpdateMetricsPersistenceFailure(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	h := New(storage.NewFileStore(filepath.Join(blocker, "metrics.json"), 0))
+	e := echo.New()
+	e.POST("/update/:typeM/:nameM/:valueM", h.UpdateMetrics())
+	e.POST("/updates/", h.UpdatesJSON())
+
+	req := httptest.NewRequest(http.MethodPost, "/update/gauge/Alloc/1.5", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(`[{"id":"PollCount","type":"counter","delta":1}]`))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	require.NoError(t, st.UpdateGauge(ctx, "Alloc", 1.5))
+	require.NoError(t, st.UpdateGauge(ctx, "9lives", 2))
+	require.NoError(t, st.UpdateGauge(ctx, "disk.used-bytes", 1e21))
+	require.NoError(t, st.UpdateGauge(ctx, "disk_used_bytes", 3))
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 7))
+	require.NoError(t, st.UpdateCounter(ctx, models.SeriesKey("PollCount", map[string]string{"host": `web "1"`}), 2))
+	e := echo.New()
+	e.GET("/metrics", New(st).PrometheusMetrics())
+
+	testCases := []struct {
+		name        string
+		target      string
+		accept      string
+		contentType string
+		want        string
+	}{
+		{
+			name:        "prometheus text",
+			target:      "/metrics",
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+			want: "# TYPE Alloc gauge\nAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount 7\nPollCount{host=\"web \\\"1\\\"\"} 2\n" +
+				"# TYPE _9lives gauge\n_9lives 2\n" +
+				"# TYPE disk_used_bytes gauge\ndisk_used_bytes 1e+21\n",
+		},
+		{
+			name:        "openmetrics by accept header",
+			target:      "/metrics",
+			accept:      "application/openmetrics-text; version=1.0.0",
+			contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+			want: "# TYPE Alloc gauge\nAlloc 1.5\n" +
+				"# TYPE PollCount counter\nPollCount_total 7\nPollCount_total{host=\"web \\\"1\\\"\"} 2\n" +
+				"# TYPE _9lives gauge\n_9lives 2\n" +
+				"# TYPE disk_used_bytes gauge\ndisk_used_bytes 1e+21\n" +
+				"# EOF\n",
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, test.contentType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, test.want, rec.Body.String())
+		})
+	}
+}
+
+func TestLabeledValues(t *testing.T) {
+	st := storage.NewMem()
+	e := echo.New()
+	h := New(st)
+	e.POST("/update/:typeM/:nameM/:valueM", h.UpdateMetrics())
+	e.POST("/update/", h.UpdateJSON())
+	e.GET("/value/:typeM/:nameM", h.MetricsValue())
+	e.POST("/value/", h.GetValueJSON())
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1.5?host=a", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":2.5,"labels":{"host":"b"}}`).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/3.5", "").Code)
+
+	assert.Equal(t, "1.5", do(http.MethodGet, "/value/gauge/Alloc?host=a", "").Body.String())
+	assert.Equal(t, "3.5", do(http.MethodGet, "/value/gauge/Alloc", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Alloc?host=c", "").Code)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":2.5,"labels":{"host":"b"}}`,
+		do(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"b"}}`).Body.String())
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":2.5,"labels":{"host":"b"}}`,
+		do(http.MethodPost, "/value/", `{"id":"Alloc","type":"gauge","labels":{"host":"b"},"stale":true}`).Body.String(),
+		"stale comes from the storage, not from the request")
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":4.5}`,
+		do(http.MethodPost, "/update/", `{"id":"Alloc","type":"gauge","value":4.5,"stale":true}`).Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/update/gauge/Alloc/1?1bad=x", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/value/gauge/Alloc?__name__=x", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/value/gauge/Al%7Bloc", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/value/", `{"id":"Al{loc","type":"gauge"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/value/", `{"id":"Alloc{}","type":"gauge"}`).Code)
+}
+
+func TestMetricHistory(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	st.SetHistory(storage.HistoryConfig{Size: 10})
+	labels := map[string]string{"host": "a"}
+	require.NoError(t, st.UpdateGauge(ctx, models.SeriesKey("Alloc", labels), 1))
+	require.NoError(t, st.UpdateGauge(ctx, models.SeriesKey("Alloc", labels), 2))
+	require.NoError(t, st.UpdateGauge(ctx, "Alloc", 3))
+	e := echo.New()
+	e.GET("/history/:typeM/:nameM", New(st).MetricHistory())
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/history/gauge/Alloc?label.host=a&nocache=1&from=" + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var h models.History
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &h))
+	assert.Equal(t, "Alloc", h.ID)
+	assert.Equal(t, labels, h.Labels)
+	require.Len(t, h.Samples, 2)
+	assert.Equal(t, 1.0, h.Samples[0].Value)
+	assert.Equal(t, 2.0, h.Samples[1].Value)
+
+	rec = get("/history/gauge/Alloc?to=" + time.Now().Add(-time.Minute).Format(time.RFC3339))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","samples":[]}`, rec.Body.String())
+
+	require.NoError(t, st.UpdateGauge(ctx, models.SeriesKey("Alloc", map[string]string{"from": "eu"}), 4))
+	rec = get("/history/gauge/Alloc?label.from=eu")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var fromLabel models.History
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &fromLabel))
+	assert.Equal(t, map[string]string{"from": "eu"}, fromLabel.Labels)
+	require.Len(t, fromLabel.Samples, 1)
+
+	assert.Equal(t, http.StatusBadRequest, get("/history/gauge/Alloc?from=yesterday").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/history/gauge/Alloc?label.1bad=x").Code)
+	assert.Equal(t, http.StatusNotFound, get("/history/gauge/Unknown").Code)
+	assert.Equal(t, http.StatusNotFound, get("/history/histogram/Alloc").Code)
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	st.SetHistory(storage.HistoryConfig{Size: 10, Rollups: storage.DefaultRollups})
+	for _, v := range []float64{1, 2, 3, 4} {
+		require.NoError(t, st.UpdateGauge(ctx, "Alloc", v))
+	}
+	key := models.SeriesKey("PollCount", map[string]string{"host": "a"})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, st.UpdateCounter(ctx, key, 10))
+	}
+	e := echo.New()
+	e.GET("/query", New(st).Query())
+	e.POST("/query", New(st).Query())
+
+	do := func(req *http.Request) (*httptest.ResponseRecorder, models.QueryResult) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var result models.QueryResult
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		}
+		return rec, result
+	}
+
+	rec, result := do(httptest.NewRequest(http.MethodGet, "/query?series=gauge/Alloc&series=gauge/Unknown&step=1h&agg=min,max,avg&agg=p50", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, int64(3600), result.Step)
+	require.Len(t, result.Series, 2)
+	alloc := result.Series[0]
+	assert.Equal(t, "raw", alloc.Source)
+	require.Len(t, alloc.Points, 1)
+	assert.Equal(t, map[string]float64{"min": 1, "max": 4, "avg": 2.5, "p50": 2.5}, alloc.Points[0].Values)
+	assert.Equal(t, "metric not found", result.Series[1].Error)
+
+	body := `{"series":[{"id":"PollCount","type":"counter","labels":{"host":"a"}}],"step":"1h","aggregations":["last","rate"]}`
+	rec, result = do(httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Len(t, result.Series[0].Points, 1)
+	assert.Equal(t, "1h", result.Series[0].Source)
+	assert.Equal(t, 30.0, result.Series[0].Points[0].Values["last"])
+	assert.InDelta(t, 20.0/3600, result.Series[0].Points[0].Values["rate"], 1e-9)
+
+	for _, target := range []string{
+		"/query",
+		"/query?series=gauge/Alloc&agg=rate",
+		"/query?series=gauge/Alloc&agg=median",
+		"/query?series=gauge/Alloc&step=0",
+		"/query?series=gauge/Alloc&from=0&step=1s",
+		"/query?series=histogram/Alloc",
+	} {
+		rec, _ := do(httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+}
+
+func TestAllMetricsValues(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	require.NoError(t, st.UpdateGauge(ctx, "HeapAlloc", 2))
+	require.NoError(t, st.UpdateGauge(ctx, "Alloc", 1.5))
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 7))
+	e := echo.New()
+	e.GET("/", New(st).AllMetricsValues())
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	t.Run("html sorted by name", func(t *testing.T) {
+		rec := get("/", "text/html")
+		assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+		body := rec.Body.String()
+		assert.Less(t, strings.Index(body, "<td>Alloc</td>"), strings.Index(body, "<td>HeapAlloc</td>"))
+		assert.Contains(t, body, "<td>PollCount</td>")
+		assert.NotContains(t, body, "<td>—</td>", "last-updated time must be shown")
+	})
+
+	t.Run("html descending", func(t *testing.T) {
+		body := get("/?sort=name&order=desc", "").Body.String()
+		assert.Greater(t, strings.Index(body, "<td>Alloc</td>"), strings.Index(body, "<td>HeapAlloc</td>"))
+	})
+
+	t.Run("name filter", func(t *testing.T) {
+		body := get("/?name=heap", "").Body.String()
+		assert.Contains(t, body, "<td>HeapAlloc</td>")
+		assert.NotContains(t, body, "<td>Alloc</td>")
+		assert.NotContains(t, body, "<td>PollCount</td>")
+	})
+
+	t.Run("text by query", func(t *testing.T) {
+		rec := get("/?format=text", "")
+		assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "Gauge metrics:\n- Alloc = 1.500000\n- HeapAlloc = 2.000000\nCounter metrics:\n- PollCount = 7\n", rec.Body.String())
+	})
+
+	t.Run("text by accept header", func(t *testing.T) {
+		rec := get("/", "text/plain")
+		assert.True(t, strings.HasPrefix(rec.Body.String(), "Gauge metrics:\n"))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		rec := get("/", "application/json")
+		var list []struct {
+			ID        string     `json:"id"`
+			UpdatedAt *time.Time `json:"updated_at"`
+			Stale     bool       `json:"stale"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+		require.Len(t, list, 3)
+		assert.Equal(t, "Alloc", list[0].ID)
+		assert.NotNil(t, list[0].UpdatedAt)
+		assert.False(t, list[0].Stale)
+	})
+}
+
+func TestStaleMetrics(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	st.SetTTL(time.Nanosecond)
+	require.NoError(t, st.UpdateGauge(ctx, "Alloc", 1.5))
+	time.Sleep(time.Millisecond)
+	h := New(st)
+	e := echo.New()
+	e.GET("/", h.AllMetricsValues())
+	e.POST("/admin/purge-stale", h.PurgeStale(time.Nanosecond))
+
+	req := httptest.NewRequest(http.MethodGet, "/?format=text", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, "Gauge metrics:\n- Alloc = 1.500000 (stale)\nCounter metrics:\n", rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), `<tr class="stale">`)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/purge-stale?older_than=1h", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"purged":0`)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/purge-stale", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"purged":1`, "server TTL is used by default")
+	_, err := st.GetGaugeValue(ctx, "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/purge-stale", nil)
+	rec = httptest.NewRecorder()
+	require.NoError(t, h.PurgeStale(0)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "no TTL and no older_than")
+}
+
+func TestAlertsWithoutRules(t *testing.T) {
+	h := New(storage.NewMem())
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	rec := httptest.NewRecorder()
+
+	require.NoError(t, h.Alerts(nil)(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+}
+
+func TestDeleteAndReset(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	web1 := models.SeriesKey("TestGauge", map[string]string{"host": "web-1"})
+	require.NoError(t, st.UpdateGauge(ctx, web1, 1))
+	require.NoError(t, st.UpdateGauge(ctx, "TestGauge", 2))
+	require.NoError(t, st.UpdateCounter(ctx, "TestCounter", 3))
+	require.NoError(t, st.UpdateCounter(ctx, "PollCount", 4))
+	h := New(st)
+	e := echo.New()
+	e.DELETE("/value/:typeM/:nameM", h.DeleteMetric())
+	e.DELETE("/values/", h.DeleteByPrefix())
+	e.POST("/reset/counter/:nameM", h.ResetCounter())
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/value/gauge/TestGauge?host=web-1").Code)
+	_, err := st.GetGaugeValue(ctx, web1)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = st.GetGaugeValue(ctx, "TestGauge")
+	assert.NoError(t, err, "series with other labels stays")
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/value/gauge/TestGauge?host=web-1").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/value/summary/TestGauge").Code)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/reset/counter/PollCount").Code)
+	poll, err := st.GetCounterValue(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), poll)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/reset/counter/Unknown").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/reset/counter/Poll%7BCount").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/value/gauge/Test%7BGauge").Code)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/values/").Code)
+	rec := do(http.MethodDelete, "/values/?prefix=Test")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"deleted":2}`, rec.Body.String())
+	metrics, err := st.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "PollCount", metrics[0].ID)
+}
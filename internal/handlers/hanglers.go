@@ -5,39 +5,46 @@ import (
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
 	"github.com/lionslon/go-yapmetrics/internal/models"
 	"github.com/lionslon/go-yapmetrics/internal/storage"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
-type storageUpdater interface {
-	UpdateCounter(string, int64)
-	UpdateGauge(string, float64)
-	GetValue(string, string) (string, int)
-	AllMetrics() string
-	GetCounterValue(string) int64
-	GetGaugeValue(string) float64
-	StoreBatch([]models.Metrics)
-}
-
 type handler struct {
-	store storageUpdater
+	store storage.MetricsStore
 }
 
-func New(stor *storage.MemStorage) *handler {
+func New(stor storage.MetricsStore) *handler {
 	return &handler{
 		store: stor,
 	}
 }
 
+// storeError отдаёт клиенту ошибку хранилища: 404 для неизвестной метрики,
+// 501 для операции, которую хранилище не поддерживает, 500 для остальных.
+func storeError(ctx echo.Context, err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return ctx.String(http.StatusNotFound, "Metric not found")
+	}
+	if errors.Is(err, storage.ErrNotSupported) {
+		return ctx.String(http.StatusNotImplemented, "Not supported by this storage")
+	}
+	logger.FromContext(ctx.Request().Context()).Error("storage error", zap.Error(err))
+	return ctx.String(http.StatusInternalServerError, "Storage error")
+}
+
 func (h *handler) UpdateMetrics() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		metricsType := ctx.Param("typeM")
 		metricsName := ctx.Param("nameM")
 		metricsValue := ctx.Param("valueM")
+		reqCtx := ctx.Request().Context()
+		metric := models.Metrics{ID: metricsName, MType: metricsType, Labels: queryLabels(ctx)}
 
 		switch metricsType {
 		case "counter":
@@ -45,13 +52,25 @@ func (h *handler) UpdateMetrics() echo.HandlerFunc {
 			if err != nil {
 				return ctx.String(http.StatusBadRequest, fmt.Sprintf("%s cannot be converted to an integer", metricsValue))
 			}
-			h.store.UpdateCounter(metricsName, value)
+			metric.Delta = &value
+			if err := metric.Validate(); err != nil {
+				return ctx.String(http.StatusBadRequest, err.Error())
+			}
+			if err := h.store.UpdateCounter(reqCtx, metric.Key(), value); err != nil {
+				return storeError(ctx, err)
+			}
 		case "gauge":
 			value, err := strconv.ParseFloat(metricsValue, 64)
 			if err != nil {
 				return ctx.String(http.StatusBadRequest, fmt.Sprintf("%s cannot be converted to a float", metricsValue))
 			}
-			h.store.UpdateGauge(metricsName, value)
+			metric.Value = &value
+			if err := metric.Validate(); err != nil {
+				return ctx.String(http.StatusBadRequest, err.Error())
+			}
+			if err := h.store.UpdateGauge(reqCtx, metric.Key(), value); err != nil {
+				return storeError(ctx, err)
+			}
 		default:
 			return ctx.String(http.StatusBadRequest, "Invalid metric type. Can only be 'gauge' or 'counter'")
 		}
@@ -65,45 +84,104 @@ func (h *handler) MetricsValue() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		typeM := ctx.Param("typeM")
 		nameM := ctx.Param("nameM")
-
-		val, status := h.store.GetValue(typeM, nameM)
-		err := ctx.String(status, val)
+		reqCtx := ctx.Request().Context()
+		key, err := seriesKey(nameM, queryLabels(ctx))
 		if err != nil {
-			return err
+			return ctx.String(http.StatusBadRequest, err.Error())
 		}
 
-		return nil
+		var val string
+		switch typeM {
+		case "counter":
+			v, err := h.store.GetCounterValue(reqCtx, key)
+			if err != nil {
+				return storeError(ctx, err)
+			}
+			val = fmt.Sprint(v)
+		case "gauge":
+			v, err := h.store.GetGaugeValue(reqCtx, key)
+			if err != nil {
+				return storeError(ctx, err)
+			}
+			val = fmt.Sprint(v)
+		default:
+			return ctx.String(http.StatusNotFound, "")
+		}
+
+		return ctx.String(http.StatusOK, val)
 	}
 }
 
-func (h *handler) AllMetricsValues() echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		ctx.Response().Header().Set("Content-Type", "text/html")
-		err := ctx.String(http.StatusOK, h.store.AllMetrics())
-		if err != nil {
-			return err
+// queryLabels метки серии из параметров запроса: /value/gauge/Alloc?host=web-1.
+func queryLabels(ctx echo.Context) map[string]string {
+	var labels map[string]string
+	for k, v := range ctx.QueryParams() {
+		if labels == nil {
+			labels = make(map[string]string)
 		}
+		labels[k] = v[0]
+	}
+	return labels
+}
 
-		return nil
+// seriesKey ключ серии из имени и меток запроса. Ключ с именем, содержащим { или }, нельзя
+// разобрать обратно в имя и метки, поэтому такой запрос отклоняется, а не доходит до хранилища.
+func seriesKey(id string, labels map[string]string) (string, error) {
+	if err := models.ValidateLabels(labels); err != nil {
+		return "", err
 	}
+	key := models.SeriesKey(id, labels)
+	if parsed, _, err := models.ParseSeriesKey(key); err != nil || parsed != id {
+		return "", fmt.Errorf("invalid metric id %q", id)
+	}
+	return key, nil
+}
+
+// metricsText список метрик в текстовом виде, устаревшие серии помечаются (stale).
+func metricsText(metrics []models.Metrics) string {
+	var gauges, counters strings.Builder
+	for _, m := range metrics {
+		stale := ""
+		if m.Stale {
+			stale = " (stale)"
+		}
+		switch m.MType {
+		case "gauge":
+			fmt.Fprintf(&gauges, "- %s = %f%s\n", m.Key(), *m.Value, stale)
+		case "counter":
+			fmt.Fprintf(&counters, "- %s = %d%s\n", m.Key(), *m.Delta, stale)
+		}
+	}
+	return "Gauge metrics:\n" + gauges.String() + "Counter metrics:\n" + counters.String()
 }
 
 func (h *handler) UpdateJSON() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		var metric models.Metrics
+		reqCtx := ctx.Request().Context()
 
 		err := json.NewDecoder(ctx.Request().Body).Decode(&metric)
 		if err != nil {
 			return ctx.String(http.StatusBadRequest, fmt.Sprintf("Error in JSON decode: %s", err))
 		}
+		// Stale заполняет только хранилище, значение от клиента в ответ не попадает.
+		metric.Stale = false
+
+		if metric.MType != "counter" && metric.MType != "gauge" {
+			return ctx.String(http.StatusNotFound, "Invalid metric type. Can only be 'gauge' or 'counter'")
+		}
+		if err := metric.Validate(); err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
 
 		switch metric.MType {
 		case "counter":
-			h.store.UpdateCounter(metric.ID, *metric.Delta)
+			err = h.store.UpdateCounter(reqCtx, metric.Key(), *metric.Delta)
 		case "gauge":
-			h.store.UpdateGauge(metric.ID, *metric.Value)
-		default:
-			return ctx.String(http.StatusNotFound, "Invalid metric type. Can only be 'gauge' or 'counter'")
+			err = h.store.UpdateGauge(reqCtx, metric.Key(), *metric.Value)
+		}
+		if err != nil {
+			return storeError(ctx, err)
 		}
 
 		ctx.Response().Header().Set("Content-Type", "application/json")
@@ -115,17 +193,29 @@ func (h *handler) GetValueJSON() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ctx.Response().Header().Set("Content-Type", "application/json")
 		var metric models.Metrics
+		reqCtx := ctx.Request().Context()
 		err := json.NewDecoder(ctx.Request().Body).Decode(&metric)
 		if err != nil {
 			return ctx.String(http.StatusBadRequest, fmt.Sprintf("Error in JSON decode: %s", err))
 		}
+		metric.Stale = false
+		key, err := seriesKey(metric.ID, metric.Labels)
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
 
 		switch metric.MType {
 		case "counter":
-			value := h.store.GetCounterValue(metric.ID)
+			value, err := h.store.GetCounterValue(reqCtx, key)
+			if err != nil {
+				return storeError(ctx, err)
+			}
 			metric.Delta = &value
 		case "gauge":
-			value := h.store.GetGaugeValue(metric.ID)
+			value, err := h.store.GetGaugeValue(reqCtx, key)
+			if err != nil {
+				return storeError(ctx, err)
+			}
 			metric.Value = &value
 
 		default:
@@ -136,14 +226,14 @@ func (h *handler) GetValueJSON() echo.HandlerFunc {
 	}
 }
 
-func (h *handler) PingDB(sw storage.StorageWorker) echo.HandlerFunc {
+func (h *handler) PingDB() echo.HandlerFunc {
 	return func(ctx echo.Context) error {
-		err := sw.Check()
+		err := h.store.Ping(ctx.Request().Context())
 		ctx.Response().Header().Set("Content-Type", "text/html")
 		if err == nil {
 			err = ctx.String(http.StatusOK, "Connection database is OK")
 		} else {
-			zap.S().Error("Connection database is NOT OK")
+			logger.FromContext(ctx.Request().Context()).Error("database ping failed", zap.Error(err))
 			err = ctx.String(http.StatusInternalServerError, "Connection database is NOT OK")
 		}
 
@@ -162,9 +252,16 @@ func (h *handler) UpdatesJSON() echo.HandlerFunc {
 		if err != nil && !errors.Is(err, io.EOF) {
 			return ctx.String(http.StatusBadRequest, fmt.Sprintf("Error in JSON decode: %s", err))
 		}
-		h.store.StoreBatch(metrics)
-		ctx.Response().Header().Set("Content-Type", "application/json")
 
-		return ctx.NoContent(http.StatusOK)
+		err = h.store.StoreBatch(ctx.Request().Context(), metrics)
+		var batchErr *storage.BatchError
+		if errors.As(err, &batchErr) {
+			return ctx.JSON(http.StatusBadRequest, models.BatchResult{Errors: batchErr.Items})
+		}
+		if err != nil {
+			return storeError(ctx, err)
+		}
+
+		return ctx.JSON(http.StatusOK, models.BatchResult{Applied: len(metrics)})
 	}
 }
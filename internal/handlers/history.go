@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+)
+
+// historyLabelPrefix префикс параметров /history/, которые задают метки серии. Остальные
+// параметры метками не считаются, поэтому у серии могут быть метки from и to.
+const historyLabelPrefix = "label."
+
+// MetricHistory отдаёт историю значений серии: /history/gauge/Alloc?from=&to=&label.host=web-1.
+// Границы from и to задаются в RFC 3339 или в секундах Unix, без них отдаётся вся история.
+// Метки серии задаются параметрами с префиксом label., прочие параметры не учитываются.
+func (h *handler) MetricHistory() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		typeM := ctx.Param("typeM")
+		if typeM != "counter" && typeM != "gauge" {
+			return ctx.String(http.StatusNotFound, "Invalid metric type. Can only be 'gauge' or 'counter'")
+		}
+		from, err := parseTime(ctx.QueryParam("from"))
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, fmt.Sprintf("from: %s", err))
+		}
+		to, err := parseTime(ctx.QueryParam("to"))
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, fmt.Sprintf("to: %s", err))
+		}
+		labels := prefixedLabels(ctx, historyLabelPrefix)
+		name := ctx.Param("nameM")
+		key, err := seriesKey(name, labels)
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+
+		samples, err := h.store.History(ctx.Request().Context(), typeM, key, from, to)
+		if err != nil {
+			return storeError(ctx, err)
+		}
+		return ctx.JSON(http.StatusOK, models.History{ID: name, MType: typeM, Labels: labels, Samples: samples})
+	}
+}
+
+// prefixedLabels метки серии из параметров запроса с префиксом prefix, без самого префикса.
+func prefixedLabels(ctx echo.Context, prefix string) map[string]string {
+	var labels map[string]string
+	for k, v := range ctx.QueryParams() {
+		name, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[name] = v[0]
+	}
+	return labels
+}
+
+// parseTime разбирает время в RFC 3339 или в секундах Unix. Пустая строка даёт нулевое время.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 or Unix seconds, got %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// PrometheusMetrics отдаёт все метрики хранилища в текстовом формате Prometheus.
+// Если клиент принимает application/openmetrics-text или передан ?format=openmetrics,
+// ответ строится в формате OpenMetrics.
+func (h *handler) PrometheusMetrics() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		metrics, err := h.store.List(ctx.Request().Context())
+		if err != nil {
+			return storeError(ctx, err)
+		}
+
+		openMetrics := ctx.QueryParam("format") == "openmetrics" ||
+			strings.Contains(ctx.Request().Header.Get("Accept"), "application/openmetrics-text")
+		contentType := models.PrometheusContentType
+		if openMetrics {
+			contentType = models.OpenMetricsContentType
+		}
+		return ctx.Blob(http.StatusOK, contentType, []byte(exposition(metrics, openMetrics, logger.FromContext(ctx.Request().Context()))))
+	}
+}
+
+type series struct {
+	name   string
+	metric models.Metrics
+}
+
+// exposition строит текст по метрикам, отсортированным по очищенному имени. Серии одной метрики
+// с разными метками выводятся в одном семействе. Если несколько метрик дают одно имя после очистки,
+// выводится первая по исходному имени, остальные пропускаются: повторяющиеся семейства
+// Prometheus не принимает.
+func exposition(metrics []models.Metrics, openMetrics bool, log *zap.Logger) string {
+	all := make([]series, 0, len(metrics))
+	for _, m := range metrics {
+		name := sanitizeName(m.ID)
+		if openMetrics && m.MType == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		all = append(all, series{name: name, metric: m})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		if all[i].metric.ID != all[j].metric.ID {
+			return all[i].metric.ID < all[j].metric.ID
+		}
+		return all[i].metric.Key() < all[j].metric.Key()
+	})
+
+	var b strings.Builder
+	var owner models.Metrics
+	for i, s := range all {
+		if i > 0 && all[i-1].name == s.name {
+			if s.metric.ID != owner.ID || s.metric.MType != owner.MType {
+				log.Warn("metric skipped in exposition: name is already used",
+					zap.String("metric", s.metric.Key()), zap.String("name", s.name), zap.String("owner", owner.ID))
+				continue
+			}
+		} else {
+			owner = s.metric
+			fmt.Fprintf(&b, "# TYPE %s %s\n", s.name, s.metric.MType)
+		}
+		labels := models.FormatLabels(s.metric.Labels)
+		switch s.metric.MType {
+		case "gauge":
+			fmt.Fprintf(&b, "%s%s %s\n", s.name, labels, models.FormatFloat(*s.metric.Value))
+		case "counter":
+			sample := s.name
+			if openMetrics {
+				sample += "_total"
+			}
+			fmt.Fprintf(&b, "%s%s %d\n", sample, labels, *s.metric.Delta)
+		}
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return b.String()
+}
+
+// sanitizeName приводит имя к виду [a-zA-Z_:][a-zA-Z0-9_:]*, заменяя остальные символы на '_'.
+func sanitizeName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
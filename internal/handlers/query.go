@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+)
+
+const (
+	defaultQueryRange = time.Hour
+	defaultQueryStep  = time.Minute
+	maxQueryPoints    = 11000
+	maxQuerySeries    = 100
+)
+
+// aggregation агрегат, который считается в каждом окне. Для квантилей quantile
+// указывает на позицию в QueryRange.Quantiles.
+type aggregation struct {
+	name     string
+	quantile int
+}
+
+// Query считает агрегаты по истории серий в окнах фиксированной длины.
+//
+// GET /query?series=gauge/Alloc&series=counter/PollCount{host="web-1"}&from=&to=&step=5m&agg=avg,max,p95
+// POST /query с телом models.QueryRequest.
+//
+// Агрегаты: min, max, avg, sum, count, last, rate (прирост счётчика в секунду) и квантили
+// вида p50, p99.9. По умолчанию берётся последний час с шагом в минуту и агрегат avg.
+// Окна выравниваются по шагу, в ответ попадают только окна, в которых есть значения.
+func (h *handler) Query() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		req, err := queryRequest(ctx)
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+		r, aggs, err := parseQuery(req, time.Now())
+		if err != nil {
+			return ctx.String(http.StatusBadRequest, err.Error())
+		}
+
+		result := models.QueryResult{
+			From:   r.From,
+			To:     r.To,
+			Step:   int64(r.Step / time.Second),
+			Series: make([]models.QuerySeries, 0, len(req.Series)),
+		}
+		for _, m := range req.Series {
+			qs := models.QuerySeries{ID: m.ID, MType: m.MType, Labels: m.Labels, Points: make([]models.QueryPoint, 0)}
+			agg, err := h.store.Aggregate(ctx.Request().Context(), m.MType, m.Key(), r)
+			if errors.Is(err, storage.ErrNotFound) {
+				qs.Error = "metric not found"
+				result.Series = append(result.Series, qs)
+				continue
+			}
+			if err != nil {
+				return storeError(ctx, err)
+			}
+			qs.Source = agg.Source
+			qs.Points = queryPoints(agg.Buckets, aggs, r.Step)
+			result.Series = append(result.Series, qs)
+		}
+		return ctx.JSON(http.StatusOK, result)
+	}
+}
+
+// queryRequest читает запрос из тела POST или из параметров GET.
+func queryRequest(ctx echo.Context) (models.QueryRequest, error) {
+	var req models.QueryRequest
+	if ctx.Request().Method == http.MethodPost {
+		if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("decode query: %w", err)
+		}
+		return req, nil
+	}
+
+	params := ctx.QueryParams()
+	for _, s := range params["series"] {
+		mType, key, ok := strings.Cut(s, "/")
+		if !ok {
+			return req, fmt.Errorf("series %q: expected type/name", s)
+		}
+		id, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			return req, fmt.Errorf("series %q: %w", s, err)
+		}
+		req.Series = append(req.Series, models.Metrics{ID: id, MType: mType, Labels: labels})
+	}
+	req.From = params.Get("from")
+	req.To = params.Get("to")
+	req.Step = params.Get("step")
+	for _, a := range params["agg"] {
+		req.Aggregations = append(req.Aggregations, strings.Split(a, ",")...)
+	}
+	return req, nil
+}
+
+// parseQuery проверяет запрос и строит окна. Начало интервала выравнивается по шагу.
+func parseQuery(req models.QueryRequest, now time.Time) (storage.QueryRange, []aggregation, error) {
+	var r storage.QueryRange
+	if len(req.Series) == 0 {
+		return r, nil, errors.New("no series requested")
+	}
+	if len(req.Series) > maxQuerySeries {
+		return r, nil, fmt.Errorf("too many series, at most %d per query", maxQuerySeries)
+	}
+	for _, m := range req.Series {
+		if m.ID == "" || (m.MType != "gauge" && m.MType != "counter") {
+			return r, nil, fmt.Errorf("series %q: expected gauge or counter with a name", m.Key())
+		}
+		if err := models.ValidateLabels(m.Labels); err != nil {
+			return r, nil, fmt.Errorf("series %q: %w", m.Key(), err)
+		}
+	}
+
+	var err error
+	if r.To, err = parseTime(req.To); err != nil {
+		return r, nil, fmt.Errorf("to: %w", err)
+	}
+	if r.To.IsZero() {
+		r.To = now
+	}
+	if r.From, err = parseTime(req.From); err != nil {
+		return r, nil, fmt.Errorf("from: %w", err)
+	}
+	if r.From.IsZero() {
+		r.From = r.To.Add(-defaultQueryRange)
+	}
+	if r.Step, err = parseStep(req.Step); err != nil {
+		return r, nil, fmt.Errorf("step: %w", err)
+	}
+	r.From = r.From.Truncate(r.Step)
+	if !r.From.Before(r.To) {
+		return r, nil, errors.New("from must be before to")
+	}
+	if r.To.Sub(r.From)/r.Step > maxQueryPoints {
+		return r, nil, fmt.Errorf("too many points, at most %d windows per series", maxQueryPoints)
+	}
+
+	names := req.Aggregations
+	if len(names) == 0 {
+		names = []string{"avg"}
+	}
+	aggs := make([]aggregation, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		a := aggregation{name: name, quantile: -1}
+		switch name {
+		case "min", "max", "avg", "sum", "count", "last":
+		case "rate":
+			for _, m := range req.Series {
+				if m.MType != "counter" {
+					return r, nil, fmt.Errorf("rate is only defined for counters, %q is a %s", m.Key(), m.MType)
+				}
+			}
+		default:
+			q, err := parsePercentile(name)
+			if err != nil {
+				return r, nil, err
+			}
+			a.quantile = len(r.Quantiles)
+			r.Quantiles = append(r.Quantiles, q)
+		}
+		aggs = append(aggs, a)
+	}
+	return r, aggs, nil
+}
+
+// parseStep разбирает шаг как длительность Go или в секундах. Шаг округляется до секунды.
+func parseStep(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultQueryStep, nil
+	}
+	step, err := time.ParseDuration(s)
+	if err != nil {
+		sec, convErr := strconv.ParseInt(s, 10, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("expected a duration or seconds, got %q", s)
+		}
+		step = time.Duration(sec) * time.Second
+	}
+	step = step.Truncate(time.Second)
+	if step <= 0 {
+		return 0, errors.New("must be at least 1s")
+	}
+	return step, nil
+}
+
+// parsePercentile разбирает агрегат вида p95 в квантиль 0.95.
+func parsePercentile(name string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+	if !strings.HasPrefix(name, "p") || err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("unknown aggregation %q", name)
+	}
+	return p / 100, nil
+}
+
+// queryPoints считает агрегаты по окнам. rate считается по последнему значению
+// предыдущего окна, а для первого окна по первому значению в нём; уменьшение
+// счётчика считается его сбросом.
+func queryPoints(buckets []models.Bucket, aggs []aggregation, step time.Duration) []models.QueryPoint {
+	points := make([]models.QueryPoint, 0, len(buckets))
+	for i, b := range buckets {
+		values := make(map[string]float64, len(aggs))
+		for _, a := range aggs {
+			switch a.name {
+			case "min":
+				values[a.name] = b.Min
+			case "max":
+				values[a.name] = b.Max
+			case "avg":
+				values[a.name] = b.Sum / float64(b.Count)
+			case "sum":
+				values[a.name] = b.Sum
+			case "count":
+				values[a.name] = float64(b.Count)
+			case "last":
+				values[a.name] = b.Last
+			case "rate":
+				base := b.First
+				if i > 0 {
+					base = buckets[i-1].Last
+				}
+				increase := b.Last - base
+				if increase < 0 {
+					increase = b.Last
+				}
+				values[a.name] = increase / step.Seconds()
+			default:
+				values[a.name] = b.Quantiles[a.quantile]
+			}
+		}
+		points = append(points, models.QueryPoint{Time: b.Start, Values: values})
+	}
+	return points
+}
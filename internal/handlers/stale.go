@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// purgeResult ответ /admin/purge-stale.
+type purgeResult struct {
+	Purged int       `json:"purged"`
+	Before time.Time `json:"before"`
+}
+
+// PurgeStale удаляет серии, которые не обновлялись дольше older_than (длительность Go
+// или секунды), по умолчанию дольше ttl сервера: POST /admin/purge-stale?older_than=1h.
+func (h *handler) PurgeStale(ttl time.Duration) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		olderThan := ttl
+		if s := ctx.QueryParam("older_than"); s != "" {
+			var err error
+			if olderThan, err = parseStep(s); err != nil {
+				return ctx.String(http.StatusBadRequest, fmt.Sprintf("older_than: %s", err))
+			}
+		}
+		if olderThan <= 0 {
+			return ctx.String(http.StatusBadRequest, "older_than is required when the server has no metric TTL")
+		}
+
+		before := time.Now().Add(-olderThan)
+		n, err := h.store.PurgeStale(ctx.Request().Context(), before)
+		if err != nil {
+			return storeError(ctx, err)
+		}
+		return ctx.JSON(http.StatusOK, purgeResult{Purged: n, Before: before})
+	}
+}
@@ -0,0 +1,98 @@
+// Package logger создаёт логгеры сервера и агента и передаёт их через context.
+//
+// Логгер не хранится в глобальной переменной: main создаёт его через New и передаёт
+// компонентам явно или в context. Обработчики запросов берут логгер из context запроса,
+// в который middleware уже добавил поле request_id.
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RequestIDHeader заголовок HTTP с идентификатором запроса. В gRPC используется
+// ключ метаданных в нижнем регистре.
+const RequestIDHeader = "X-Request-ID"
+
+// New создаёт логгер с уровнем level (debug, info, warn, error) в формате format:
+// json для сбора логов или console для чтения глазами.
+func New(level, format string) (*zap.Logger, error) {
+	lvl, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	var cfg zap.Config
+	switch format {
+	case "json":
+		cfg = zap.NewProductionConfig()
+		cfg.EncoderConfig.TimeKey = "time"
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+		cfg.Development = false
+	default:
+		return nil, fmt.Errorf("unknown log format %q, can only be 'json' or 'console'", format)
+	}
+	cfg.Level = lvl
+	// Каждая строка лога запроса нужна целиком, поэтому выборка отключена.
+	cfg.Sampling = nil
+	return cfg.Build()
+}
+
+type loggerKey struct{}
+
+type requestIDKey struct{}
+
+// WithContext возвращает context с логгером l.
+func WithContext(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext логгер из context или логгер, который ничего не пишет.
+func FromContext(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return zap.NewNop()
+}
+
+// WithRequestID запоминает идентификатор запроса и добавляет его полем request_id
+// к логгеру из context.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return WithContext(ctx, FromContext(ctx).With(zap.String("request_id", id)))
+}
+
+// RequestID идентификатор запроса из context или пустая строка.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID случайный идентификатор запроса из 32 шестнадцатеричных символов.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID проверяет идентификатор, пришедший от клиента: не длиннее 128 символов,
+// только печатные ASCII без пробелов, чтобы его можно было без опаски писать в лог.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNew(t *testing.T) {
+	l, err := New("debug", "json")
+	require.NoError(t, err)
+	assert.True(t, l.Core().Enabled(zapcore.DebugLevel))
+
+	l, err = New("warn", "console")
+	require.NoError(t, err)
+	assert.False(t, l.Core().Enabled(zapcore.InfoLevel))
+
+	_, err = New("loud", "json")
+	assert.Error(t, err)
+	_, err = New("info", "xml")
+	assert.Error(t, err)
+}
+
+func TestWithRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	ctx := WithRequestID(WithContext(context.Background(), zap.New(core)), "abc")
+
+	FromContext(ctx).Info("handled")
+	assert.Equal(t, "abc", RequestID(ctx))
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "abc", logs.All()[0].ContextMap()["request_id"])
+
+	assert.Empty(t, RequestID(context.Background()))
+	assert.NotPanics(t, func() { FromContext(context.Background()).Info("dropped") })
+}
+
+func TestValidRequestID(t *testing.T) {
+	assert.True(t, ValidRequestID(NewRequestID()))
+	assert.True(t, ValidRequestID("agent-42"))
+	assert.False(t, ValidRequestID(""))
+	assert.False(t, ValidRequestID("a b"))
+	assert.False(t, ValidRequestID("line\nbreak"))
+	assert.False(t, ValidRequestID(string(make([]byte, 129))))
+}
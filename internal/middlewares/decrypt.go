@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/encryption"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Decrypt расшифровывает тело запроса закрытым ключом. Запросы с непустым телом без
+// заголовка encryption.Header отклоняются. Регистрируется до GzipUnpacking: агент
+// сначала сжимает тело, а потом шифрует.
+func Decrypt(priv *rsa.PrivateKey) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return ctx.String(http.StatusBadRequest, "")
+			}
+			if len(body) == 0 {
+				req.Body = io.NopCloser(bytes.NewReader(body))
+				return next(ctx)
+			}
+			if req.Header.Get(encryption.Header) != encryption.Scheme {
+				return ctx.String(http.StatusBadRequest, "request body must be encrypted")
+			}
+
+			plain, err := encryption.Decrypt(priv, body)
+			if err != nil {
+				logger.FromContext(req.Context()).Warn("cannot decrypt request body", zap.Error(err))
+				return ctx.String(http.StatusBadRequest, "cannot decrypt request body")
+			}
+			req.Header.Del(encryption.Header)
+			req.Body = io.NopCloser(bytes.NewReader(plain))
+			req.ContentLength = int64(len(plain))
+			return next(ctx)
+		}
+	}
+}
@@ -3,22 +3,54 @@ package middlewares
 import (
 	"compress/gzip"
 	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
 	"io"
 	"net/http"
 	"strings"
 )
 
+// countingWriter считает байты, записанные в w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader считает байты, прочитанные из r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // compressWriter реализует интерфейс http.ResponseWriter и позволяет прозрачно для сервера
 // сжимать передаваемые данные и выставлять правильные HTTP-заголовки
 type compressWriter struct {
-	w  http.ResponseWriter
-	zw *gzip.Writer
+	w      http.ResponseWriter
+	zw     *gzip.Writer
+	out    *countingWriter // сжатые байты
+	in     int64           // байты до сжатия
+	head   bool            // ответ на HEAD, тела у него нет
+	status int             // отправленный статус, 0 до WriteHeader
 }
 
-func newCompressWriter(w http.ResponseWriter) *compressWriter {
+func newCompressWriter(w http.ResponseWriter, head bool) *compressWriter {
+	out := &countingWriter{w: w}
 	return &compressWriter{
-		w:  w,
-		zw: gzip.NewWriter(w),
+		w:    w,
+		zw:   gzip.NewWriter(out),
+		out:  out,
+		head: head,
 	}
 }
 
@@ -27,30 +59,53 @@ func (c *compressWriter) Header() http.Header {
 }
 
 func (c *compressWriter) Write(p []byte) (int, error) {
-	return c.zw.Write(p)
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.compresses() {
+		return c.w.Write(p)
+	}
+	n, err := c.zw.Write(p)
+	c.in += int64(n)
+	return n, err
 }
 
+// WriteHeader выставляет Content-Encoding, если у ответа есть тело. Сжимаются и ответы
+// с ошибками, а 1xx, 204, 304 и ответы на HEAD отправляются без тела и без заголовка.
 func (c *compressWriter) WriteHeader(statusCode int) {
-	if statusCode < 300 {
+	c.status = statusCode
+	if c.compresses() {
 		c.w.Header().Set("Content-Encoding", "gzip")
 	}
 	c.w.WriteHeader(statusCode)
 }
 
-// Close закрывает gzip.Writer и досылает все данные из буфера.
+func (c *compressWriter) compresses() bool {
+	return !c.head && c.status >= http.StatusOK &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified
+}
+
+// Close закрывает gzip.Writer и досылает все данные из буфера. Ответу без тела
+// завершение gzip-потока не отправляется.
 func (c *compressWriter) Close() error {
+	if !c.compresses() {
+		return nil
+	}
 	return c.zw.Close()
 }
 
 // compressReader реализует интерфейс io.ReadCloser и позволяет прозрачно для сервера
 // декомпрессировать получаемые от клиента данные
 type compressReader struct {
-	r  io.ReadCloser
-	zr *gzip.Reader
+	r   io.ReadCloser
+	zr  *gzip.Reader
+	in  *countingReader // сжатые байты
+	out int64           // байты после распаковки
 }
 
 func newCompressReader(r io.ReadCloser) (*compressReader, error) {
-	zr, err := gzip.NewReader(r)
+	in := &countingReader{r: r}
+	zr, err := gzip.NewReader(in)
 	if err != nil {
 		return nil, err
 	}
@@ -58,11 +113,14 @@ func newCompressReader(r io.ReadCloser) (*compressReader, error) {
 	return &compressReader{
 		r:  r,
 		zr: zr,
+		in: in,
 	}, nil
 }
 
-func (c compressReader) Read(p []byte) (n int, err error) {
-	return c.zr.Read(p)
+func (c *compressReader) Read(p []byte) (n int, err error) {
+	n, err = c.zr.Read(p)
+	c.out += int64(n)
+	return n, err
 }
 
 func (c *compressReader) Close() error {
@@ -72,16 +130,22 @@ func (c *compressReader) Close() error {
 	return c.zr.Close()
 }
 
+// GzipUnpacking распаковывает тела запросов с Content-Encoding: gzip и сжимает ответы
+// клиентам, которые принимают gzip. Степень сжатия учитывается в метриках сервера из context.
 func GzipUnpacking() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) (err error) {
 			req := ctx.Request()
 			rw := ctx.Response().Writer
 			header := req.Header
+			metrics := selfmetrics.FromContext(req.Context())
 			if strings.Contains(header.Get("Accept-Encoding"), "gzip") {
-				cw := newCompressWriter(rw)
+				cw := newCompressWriter(rw, req.Method == http.MethodHead)
 				ctx.Response().Writer = cw
-				defer cw.Close()
+				defer func() {
+					cw.Close()
+					metrics.ObserveGzip("response", cw.out.n, cw.in)
+				}()
 			}
 
 			if strings.Contains(header.Get("Content-Encoding"), "gzip") {
@@ -90,7 +154,10 @@ func GzipUnpacking() echo.MiddlewareFunc {
 					return ctx.String(http.StatusInternalServerError, "")
 				}
 				ctx.Request().Body = cr
-				defer cr.Close()
+				defer func() {
+					cr.Close()
+					metrics.ObserveGzip("request", cr.in.n, cr.out)
+				}()
 			}
 			if err = next(ctx); err != nil {
 				ctx.Error(err)
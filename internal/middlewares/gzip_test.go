@@ -0,0 +1,54 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipResponses(t *testing.T) {
+	e := echo.New()
+	e.Use(GzipUnpacking())
+	e.Match([]string{http.MethodGet, http.MethodHead}, "/ok", func(ctx echo.Context) error {
+		return ctx.String(http.StatusOK, "hello")
+	})
+	e.GET("/bad", func(ctx echo.Context) error {
+		return ctx.String(http.StatusBadRequest, "bad request")
+	})
+	e.GET("/empty", func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusNoContent)
+	})
+	e.GET("/cached", func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusNotModified)
+	})
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	gunzip := func(rec *httptest.ResponseRecorder) string {
+		require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		zr, err := gzip.NewReader(rec.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "hello", gunzip(do(http.MethodGet, "/ok")))
+	assert.Equal(t, "bad request", gunzip(do(http.MethodGet, "/bad")), "error bodies are compressed too")
+	for _, rec := range []*httptest.ResponseRecorder{do(http.MethodGet, "/empty"), do(http.MethodGet, "/cached")} {
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.Zero(t, rec.Body.Len(), "bodyless responses must not get a gzip stream")
+	}
+	assert.Empty(t, do(http.MethodHead, "/ok").Header().Get("Content-Encoding"))
+}
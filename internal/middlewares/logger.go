@@ -2,10 +2,31 @@ package middlewares
 
 import (
 	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/logger"
 	"go.uber.org/zap"
 	"time"
 )
 
+// RequestID берёт идентификатор запроса из заголовка X-Request-ID или создаёт новый,
+// возвращает его в ответе и кладёт в context запроса логгер log с полем request_id.
+// Регистрируется первым, чтобы идентификатор был у всех строк лога и у всех ответов.
+func RequestID(log *zap.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			req := ctx.Request()
+			id := req.Header.Get(logger.RequestIDHeader)
+			if !logger.ValidRequestID(id) {
+				id = logger.NewRequestID()
+			}
+			ctx.Response().Header().Set(logger.RequestIDHeader, id)
+			reqCtx := logger.WithRequestID(logger.WithContext(req.Context(), log), id)
+			ctx.SetRequest(req.WithContext(reqCtx))
+			return next(ctx)
+		}
+	}
+}
+
+// WithLogging пишет в лог каждого запроса метод, путь, код ответа, размер и длительность.
 func WithLogging() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) (err error) {
@@ -16,14 +37,12 @@ func WithLogging() echo.MiddlewareFunc {
 			if err = next(ctx); err != nil {
 				ctx.Error(err)
 			}
-			duration := time.Since(start)
-			// logging
-			zap.S().Infoln(
-				"uri:", req.RequestURI,
-				"method:", req.Method,
-				"duration:", duration,
-				"status:", res.Status,
-				"size:", res.Size,
+			logger.FromContext(req.Context()).Info("request",
+				zap.String("method", req.Method),
+				zap.String("uri", req.RequestURI),
+				zap.Int("status", res.Status),
+				zap.Int64("size", res.Size),
+				zap.Duration("duration", time.Since(start)),
 			)
 
 			return err
@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
+)
+
+// Instrument учитывает каждый запрос в метриках сервера m: маршрут, метод, код ответа
+// и длительность. Кладёт m в context запроса, чтобы следующие middleware могли учитывать
+// свои события. Регистрируется сразу после RequestID.
+func Instrument(m *selfmetrics.Metrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) (err error) {
+			start := time.Now()
+			req := ctx.Request()
+			ctx.SetRequest(req.WithContext(selfmetrics.WithContext(req.Context(), m)))
+			if err = next(ctx); err != nil {
+				ctx.Error(err)
+			}
+			// Запросы без маршрута учитываются вместе, а не по пути: иначе любой клиент
+			// мог бы создать сколько угодно серий.
+			route := ctx.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			m.ObserveRequest("http", route, req.Method, strconv.Itoa(ctx.Response().Status), time.Since(start))
+			return err
+		}
+	}
+}
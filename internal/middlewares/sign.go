@@ -2,15 +2,16 @@ package middlewares
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"github.com/labstack/echo/v4"
-	"hash"
+	"github.com/lionslon/go-yapmetrics/internal/selfmetrics"
+	"github.com/lionslon/go-yapmetrics/internal/sign"
 	"io"
 	"net/http"
+	"strings"
 )
 
+// CheckSignReq проверяет подпись HashSHA256 запроса. У запросов на удаление и сброс
+// метрик подписывается не только тело, но и метод с путём, см. sign.Target.
 func CheckSignReq(password string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) (err error) {
@@ -18,10 +19,14 @@ func CheckSignReq(password string) echo.MiddlewareFunc {
 			body, err := io.ReadAll(req.Body)
 			if err == nil {
 				singPassword := []byte(password)
-				bodyHash := GetSign(body, singPassword)
 				signR := req.Header.Get("HashSHA256")
+				signed := body
+				if signsTarget(req) {
+					signed = sign.Target(req.Method, req.URL.RequestURI(), body)
+				}
 
-				if signR != bodyHash {
+				if !sign.Valid(signed, singPassword, signR) {
+					selfmetrics.FromContext(req.Context()).SignatureFailure("http")
 					return ctx.String(http.StatusBadRequest, "signature is not valid")
 				}
 			}
@@ -31,20 +36,52 @@ func CheckSignReq(password string) echo.MiddlewareFunc {
 	}
 }
 
-func GetSign(body []byte, pass []byte) string {
-	hashValue := hmac.New(sha256.New, pass)
-	hashValue.Write(body)
-	sum := hashValue.Sum(nil)
-	return hex.EncodeToString(sum)
+// signsTarget запросы, которые удаляют или сбрасывают метрики, включая /admin/purge-stale.
+// Обычно у них нет тела, и подпись одного тела подошла бы к любому такому запросу.
+func signsTarget(req *http.Request) bool {
+	return req.Method == http.MethodDelete ||
+		strings.HasPrefix(req.URL.Path, "/reset/") ||
+		strings.HasPrefix(req.URL.Path, "/admin/")
 }
 
+// signResponseWriter копит ответ целиком: заголовок HashSHA256 можно выставить
+// только до отправки статуса, а подпись известна лишь после последней записи тела.
 type signResponseWriter struct {
 	http.ResponseWriter
-	hash hash.Hash
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
 }
 
-func (w signResponseWriter) Write(b []byte) (int, error) {
-	w.hash.Write(b)
-	w.Header().Set("HashSHA256", hex.EncodeToString(w.hash.Sum(nil)))
-	return w.ResponseWriter.Write(b)
+func (w *signResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// SignResponse подписывает тело ответа заголовком HashSHA256. Подписывается несжатое тело,
+// поэтому middleware регистрируется после GzipUnpacking.
+func SignResponse(password string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) (err error) {
+			res := ctx.Response()
+			sw := &signResponseWriter{ResponseWriter: res.Writer, status: http.StatusOK}
+			res.Writer = sw
+			if err = next(ctx); err != nil {
+				ctx.Error(err)
+			}
+			res.Writer = sw.ResponseWriter
+
+			if !res.Committed {
+				return err
+			}
+			sw.Header().Set("HashSHA256", sign.Sum(sw.body.Bytes(), []byte(password)))
+			sw.ResponseWriter.WriteHeader(sw.status)
+			if _, writeErr := sw.ResponseWriter.Write(sw.body.Bytes()); writeErr != nil && err == nil {
+				err = writeErr
+			}
+			return err
+		}
+	}
 }
@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TrustedSubnet пропускает только запросы, у которых адрес из заголовка X-Real-IP
+// входит в подсеть subnet. Запросы без заголовка отклоняются.
+func TrustedSubnet(subnet *net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !InSubnet(subnet, ctx.Request().Header.Get("X-Real-IP")) {
+				return ctx.String(http.StatusForbidden, "address is not in the trusted subnet")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// InSubnet сообщает, является ли addr корректным IP-адресом из подсети subnet.
+func InSubnet(subnet *net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && subnet.Contains(ip)
+}
@@ -0,0 +1,204 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// lockID ключ advisory-блокировки, чтобы несколько серверов не накатывали миграции одновременно.
+const lockID = 715517
+
+const createVersionTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer PRIMARY KEY,
+	name text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+);`
+
+// Migration одна версия схемы. Файлы называются NNNN_name.up.sql и NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func New(db *sql.DB) (*Migrator, error) {
+	ms, err := load(sqlFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+func load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, name := range names {
+		base := path.Base(name)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql suffix", base)
+		}
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		num, title, ok := strings.Cut(stem, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name prefix", base)
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", base, num)
+		}
+
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		} else if m.Name != title {
+			return nil, fmt.Errorf("migration %d: conflicting names %q and %q", version, m.Name, title)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d: both up and down files are required", m.Version)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	for i, m := range result {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return result, nil
+}
+
+// Latest номер последней известной миграции.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version текущая версия схемы в базе, 0 если миграции ещё не применялись.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if _, err := m.db.ExecContext(ctx, createVersionTable); err != nil {
+		return 0, err
+	}
+	var v int
+	err := m.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&v)
+	return v, err
+}
+
+// Up применяет все недостающие миграции по порядку и возвращает их количество.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if _, err := m.db.ExecContext(ctx, createVersionTable); err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, mg := range m.migrations {
+		ok, err := m.step(ctx, mg, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s up: %w", mg.Version, mg.Name, err)
+		}
+		if ok {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// Down откатывает steps последних применённых миграций.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if _, err := m.db.ExecContext(ctx, createVersionTable); err != nil {
+		return 0, err
+	}
+	reverted := 0
+	for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		mg := m.migrations[i]
+		ok, err := m.step(ctx, mg, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s down: %w", mg.Version, mg.Name, err)
+		}
+		if ok {
+			reverted++
+		}
+	}
+	return reverted, nil
+}
+
+// step применяет или откатывает одну миграцию в отдельной транзакции вместе с записью о версии.
+// Возвращает false, если миграция уже в нужном состоянии.
+func (m *Migrator) step(ctx context.Context, mg Migration, up bool) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", lockID); err != nil {
+		return false, err
+	}
+	var current int
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").Scan(&current)
+	if err != nil {
+		return false, err
+	}
+
+	if up {
+		if current >= mg.Version {
+			return false, nil
+		}
+		if _, err := tx.ExecContext(ctx, mg.Up); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);", mg.Version, mg.Name)
+	} else {
+		if current != mg.Version {
+			return false, nil
+		}
+		if _, err := tx.ExecContext(ctx, mg.Down); err != nil {
+			return false, err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1;", mg.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
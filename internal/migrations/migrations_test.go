@@ -0,0 +1,107 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	ms, err := load(sqlFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, ms)
+
+	first := ms[0]
+	assert.Equal(t, 1, first.Version)
+	assert.Contains(t, first.Up, "TYPE text")
+	assert.Contains(t, first.Up, "TYPE bigint")
+	assert.Contains(t, first.Up, "PRIMARY KEY")
+	assert.Contains(t, first.Up, "updated_at")
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	testCases := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{name: "missing down", files: fstest.MapFS{
+			"sql/0001_init.up.sql": {Data: []byte("SELECT 1;")},
+		}},
+		{name: "gap in versions", files: fstest.MapFS{
+			"sql/0001_init.up.sql":   {Data: []byte("SELECT 1;")},
+			"sql/0001_init.down.sql": {Data: []byte("SELECT 1;")},
+			"sql/0003_next.up.sql":   {Data: []byte("SELECT 1;")},
+			"sql/0003_next.down.sql": {Data: []byte("SELECT 1;")},
+		}},
+		{name: "bad version", files: fstest.MapFS{
+			"sql/init.up.sql":   {Data: []byte("SELECT 1;")},
+			"sql/init.down.sql": {Data: []byte("SELECT 1;")},
+		}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := load(test.files)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func newMockMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return &Migrator{db: db, migrations: []Migration{
+		{Version: 1, Name: "first", Up: "CREATE TABLE a (id int);", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "second", Up: "CREATE TABLE b (id int);", Down: "DROP TABLE b;"},
+	}}, mock
+}
+
+func expectStep(mock sqlmock.Sqlmock, current int) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock($1);").WithArgs(lockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE(MAX(version), 0) FROM schema_migrations;").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(current))
+}
+
+func TestUpAppliesOnlyPending(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	mock.ExpectExec(createVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	expectStep(mock, 1)
+	mock.ExpectRollback()
+
+	expectStep(mock, 1)
+	mock.ExpectExec("CREATE TABLE b (id int);").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2);").
+		WithArgs(2, "second").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	applied, err := m.Up(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDownRevertsLatest(t *testing.T) {
+	m, mock := newMockMigrator(t)
+	mock.ExpectExec(createVersionTable).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	expectStep(mock, 2)
+	mock.ExpectExec("DROP TABLE b;").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = $1;").
+		WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	reverted, err := m.Down(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reverted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
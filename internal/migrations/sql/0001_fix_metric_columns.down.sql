@@ -0,0 +1,16 @@
+ALTER TABLE counter_metrics
+    DROP CONSTRAINT counter_metrics_pkey,
+    DROP COLUMN updated_at,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN name TYPE char(30),
+    ALTER COLUMN value DROP NOT NULL,
+    ALTER COLUMN value TYPE integer,
+    ADD CONSTRAINT counter_metrics_name_key UNIQUE (name);
+
+ALTER TABLE gauge_metrics
+    DROP CONSTRAINT gauge_metrics_pkey,
+    DROP COLUMN updated_at,
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN name TYPE char(30),
+    ALTER COLUMN value DROP NOT NULL,
+    ADD CONSTRAINT gauge_metrics_name_key UNIQUE (name);
@@ -0,0 +1,25 @@
+-- Таблицы могли быть созданы старыми версиями сервера с name char(30) и value integer.
+CREATE TABLE IF NOT EXISTS counter_metrics (name char(30) UNIQUE, value integer);
+CREATE TABLE IF NOT EXISTS gauge_metrics (name char(30) UNIQUE, value double precision);
+
+DELETE FROM counter_metrics WHERE name IS NULL;
+DELETE FROM gauge_metrics WHERE name IS NULL;
+UPDATE counter_metrics SET value = 0 WHERE value IS NULL;
+UPDATE gauge_metrics SET value = 0 WHERE value IS NULL;
+
+ALTER TABLE counter_metrics DROP CONSTRAINT IF EXISTS counter_metrics_name_key;
+ALTER TABLE counter_metrics
+    ALTER COLUMN name TYPE text USING rtrim(name),
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN value TYPE bigint,
+    ALTER COLUMN value SET NOT NULL,
+    ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+    ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name);
+
+ALTER TABLE gauge_metrics DROP CONSTRAINT IF EXISTS gauge_metrics_name_key;
+ALTER TABLE gauge_metrics
+    ALTER COLUMN name TYPE text USING rtrim(name),
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN value SET NOT NULL,
+    ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+    ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name);
@@ -0,0 +1,10 @@
+-- Серии с метками не помещаются в прежнюю схему и удаляются.
+DELETE FROM counter_metrics WHERE labels <> '{}';
+ALTER TABLE counter_metrics DROP CONSTRAINT counter_metrics_pkey;
+ALTER TABLE counter_metrics DROP COLUMN labels;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name);
+
+DELETE FROM gauge_metrics WHERE labels <> '{}';
+ALTER TABLE gauge_metrics DROP CONSTRAINT gauge_metrics_pkey;
+ALTER TABLE gauge_metrics DROP COLUMN labels;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name);
@@ -0,0 +1,8 @@
+-- Серия метрики определяется именем и метками, поэтому метки входят в первичный ключ.
+ALTER TABLE counter_metrics ADD COLUMN labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE counter_metrics DROP CONSTRAINT counter_metrics_pkey;
+ALTER TABLE counter_metrics ADD CONSTRAINT counter_metrics_pkey PRIMARY KEY (name, labels);
+
+ALTER TABLE gauge_metrics ADD COLUMN labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE gauge_metrics DROP CONSTRAINT gauge_metrics_pkey;
+ALTER TABLE gauge_metrics ADD CONSTRAINT gauge_metrics_pkey PRIMARY KEY (name, labels);
@@ -0,0 +1,11 @@
+-- История значений серий. Для counter хранится накопленная сумма после обновления.
+CREATE TABLE metric_history (
+    id bigserial PRIMARY KEY,
+    mtype text NOT NULL,
+    name text NOT NULL,
+    labels jsonb NOT NULL DEFAULT '{}',
+    value double precision NOT NULL,
+    recorded_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX metric_history_series_idx ON metric_history (mtype, name, labels, recorded_at);
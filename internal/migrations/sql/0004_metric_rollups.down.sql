@@ -0,0 +1 @@
+DROP TABLE metric_rollups;
@@ -0,0 +1,15 @@
+-- Предагрегированная история: статистика серии за окна длиной resolution секунд.
+CREATE TABLE metric_rollups (
+    resolution integer NOT NULL,
+    mtype text NOT NULL,
+    name text NOT NULL,
+    labels jsonb NOT NULL DEFAULT '{}',
+    bucket_start timestamptz NOT NULL,
+    count bigint NOT NULL,
+    sum double precision NOT NULL,
+    min double precision NOT NULL,
+    max double precision NOT NULL,
+    first double precision NOT NULL,
+    last double precision NOT NULL,
+    PRIMARY KEY (resolution, mtype, name, labels, bucket_start)
+);
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"math"
+	"strconv"
+)
+
+// Типы содержимого текстовых форматов Prometheus и OpenMetrics.
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// FormatFloat записывает значение так, как его ждёт текстовый формат Prometheus:
+// бесконечности и NaN в виде +Inf, -Inf и NaN.
+func FormatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
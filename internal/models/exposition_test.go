@@ -0,0 +1,16 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFloat(t *testing.T) {
+	assert.Equal(t, "1.5", FormatFloat(1.5))
+	assert.Equal(t, "1e+21", FormatFloat(1e21))
+	assert.Equal(t, "+Inf", FormatFloat(math.Inf(1)))
+	assert.Equal(t, "-Inf", FormatFloat(math.Inf(-1)))
+	assert.Equal(t, "NaN", FormatFloat(math.NaN()))
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Серия метрики определяется именем и набором меток. Хранилища адресуют серию ключом
+// вида name{k1="v1",k2="v2"}: метки отсортированы по имени, значения экранированы
+// так же, как в текстовом формате Prometheus. У серии без меток ключ равен имени,
+// поэтому ключи старых метрик не меняются.
+
+// ValidateLabels проверяет имена меток: они должны подходить под правила Prometheus
+// и не начинаться с зарезервированного префикса "__".
+func ValidateLabels(labels map[string]string) error {
+	for k := range labels {
+		if !validLabelName(k) {
+			return fmt.Errorf("invalid label name %q", k)
+		}
+		if strings.HasPrefix(k, "__") {
+			return fmt.Errorf("label name %q is reserved", k)
+		}
+	}
+	return nil
+}
+
+func validLabelName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FormatLabels возвращает метки в виде {k1="v1",k2="v2"} или пустую строку, если меток нет.
+func FormatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// SeriesKey ключ серии с именем id и метками labels.
+func SeriesKey(id string, labels map[string]string) string {
+	return id + FormatLabels(labels)
+}
+
+// Key ключ серии метрики.
+func (m Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+var errMalformedKey = errors.New("malformed series key")
+
+// ParseSeriesKey разбирает ключ, построенный SeriesKey, на имя и метки.
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, nil, nil
+	}
+	id, rest := key[:i], key[i+1:]
+	if !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("%w: %q", errMalformedKey, key)
+	}
+	rest = rest[:len(rest)-1]
+
+	labels := make(map[string]string)
+	for rest != "" {
+		name, tail, ok := strings.Cut(rest, `="`)
+		if !ok {
+			return "", nil, fmt.Errorf("%w: %q", errMalformedKey, key)
+		}
+		var value strings.Builder
+		closed := false
+		j := 0
+		for ; j < len(tail); j++ {
+			c := tail[j]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && j+1 < len(tail) {
+				j++
+				switch tail[j] {
+				case 'n':
+					c = '\n'
+				default:
+					c = tail[j]
+				}
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, fmt.Errorf("%w: %q", errMalformedKey, key)
+		}
+		labels[name] = value.String()
+		rest = tail[j+1:]
+		if rest != "" {
+			if rest[0] != ',' {
+				return "", nil, fmt.Errorf("%w: %q", errMalformedKey, key)
+			}
+			rest = rest[1:]
+		}
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	return id, labels, nil
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesKeyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		labels map[string]string
+		key    string
+	}{
+		{name: "without labels", id: "Alloc", key: "Alloc"},
+		{name: "sorted labels", id: "Alloc", labels: map[string]string{"instance": "i-1", "host": "web"}, key: `Alloc{host="web",instance="i-1"}`},
+		{name: "escaped value", id: "Alloc", labels: map[string]string{"path": `C:\tmp "x",` + "\n"}, key: `Alloc{path="C:\\tmp \"x\",\n"}`},
+		{name: "empty value", id: "Alloc", labels: map[string]string{"host": ""}, key: `Alloc{host=""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesKey(tt.id, tt.labels)
+			assert.Equal(t, tt.key, key)
+
+			id, labels, err := ParseSeriesKey(key)
+			require.NoError(t, err)
+			assert.Equal(t, tt.id, id)
+			assert.Equal(t, tt.labels, labels)
+		})
+	}
+}
+
+func TestParseSeriesKeyRejectsMalformed(t *testing.T) {
+	for _, key := range []string{`Alloc{host="web"`, `Alloc{host=web}`, `Alloc{host="web}`, `Alloc{a="1"b="2"}`} {
+		_, _, err := ParseSeriesKey(key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	value := 1.0
+	assert.NoError(t, Metrics{ID: "Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"host_1": "x"}}.Validate())
+	assert.Error(t, Metrics{ID: "Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"1host": "x"}}.Validate())
+	assert.Error(t, Metrics{ID: "Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"__name__": "x"}}.Validate())
+	assert.Error(t, Metrics{ID: "Alloc{host=\"x\"}", MType: "gauge", Value: &value}.Validate())
+}
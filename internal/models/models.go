@@ -1,8 +1,128 @@
 package models
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReservedPrefix префикс имён собственных метрик сервера. Клиенты не могут записывать
+// метрики с таким префиксом, чтобы не смешивать их с метриками сервера.
+const ReservedPrefix = "yapmetrics_"
+
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID        string            `json:"id"`               // имя метрики
+	MType     string            `json:"type"`             // параметр, принимающий значение gauge или counter
+	Delta     *int64            `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value     *float64          `json:"value,omitempty"`  // значение метрики в случае передачи gauge
+	Labels    map[string]string `json:"labels,omitempty"` // метки серии, например host и instance
+	UpdatedAt time.Time         `json:"-"`                // время последнего обновления, заполняется хранилищем в List
+	Stale     bool              `json:"stale,omitempty"`  // серия не обновлялась дольше TTL хранилища, заполняется в List
+}
+
+// Validate проверяет, что метрику от клиента можно сохранить: имя задано и не зарезервировано,
+// тип известен и передано значение для этого типа.
+func (m Metrics) Validate() error {
+	if m.ID == "" {
+		return errors.New("empty metric id")
+	}
+	if strings.ContainsAny(m.ID, "{}") {
+		return errors.New("metric id must not contain '{' or '}'")
+	}
+	if strings.HasPrefix(m.ID, ReservedPrefix) {
+		return fmt.Errorf("metric id prefix %q is reserved for server metrics", ReservedPrefix)
+	}
+	if err := ValidateLabels(m.Labels); err != nil {
+		return err
+	}
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return errors.New("counter without delta")
+		}
+	case "gauge":
+		if m.Value == nil {
+			return errors.New("gauge without value")
+		}
+	default:
+		return errors.New("invalid metric type, can only be 'gauge' or 'counter'")
+	}
+	return nil
+}
+
+// BatchItemError описывает отклонённый элемент пакета /updates/.
+type BatchItemError struct {
+	Index  int    `json:"index"`  // позиция элемента в пакете
+	ID     string `json:"id"`     // имя метрики
+	Reason string `json:"reason"` // причина отказа
+}
+
+// BatchResult ответ на /updates/. Пакет применяется целиком или не применяется вовсе,
+// поэтому при непустом Errors значение Applied равно нулю.
+type BatchResult struct {
+	Applied int              `json:"applied"`
+	Errors  []BatchItemError `json:"errors,omitempty"`
+}
+
+// Sample значение серии в момент обновления. Для counter это накопленная сумма.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// History ответ /history/: значения одной серии в хронологическом порядке.
+type History struct {
+	ID      string            `json:"id"`
+	MType   string            `json:"type"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Samples []Sample          `json:"samples"`
+}
+
+// Bucket статистика значений серии в одном окне запроса /query. Quantiles идут
+// в том же порядке, что и запрошенные квантили.
+type Bucket struct {
+	Start     time.Time
+	Count     int64
+	Sum       float64
+	Min       float64
+	Max       float64
+	First     float64
+	Last      float64
+	Quantiles []float64
+}
+
+// QueryRequest тело POST /query. From и To задаются в RFC 3339 или в секундах Unix,
+// Step как длительность Go ("5m") или в секундах. В Series используются ID, MType и Labels.
+type QueryRequest struct {
+	Series       []Metrics `json:"series"`
+	From         string    `json:"from,omitempty"`
+	To           string    `json:"to,omitempty"`
+	Step         string    `json:"step,omitempty"`
+	Aggregations []string  `json:"aggregations,omitempty"`
+}
+
+// QueryPoint значения агрегатов в окне, которое начинается в Time.
+type QueryPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// QuerySeries результат запроса по одной серии. Source показывает, посчитан ли он
+// по исходной истории ("raw") или по уровню предагрегации ("1m", "1h").
+type QuerySeries struct {
+	ID     string            `json:"id"`
+	MType  string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Source string            `json:"source,omitempty"`
+	Points []QueryPoint      `json:"points"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// QueryResult ответ /query. Step в секундах.
+type QueryResult struct {
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   int64         `json:"step"`
+	Series []QuerySeries `json:"series"`
 }
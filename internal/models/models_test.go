@@ -0,0 +1,13 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRejectsReservedPrefix(t *testing.T) {
+	v := 1.0
+	assert.Error(t, Metrics{ID: ReservedPrefix + "requests_total", MType: "gauge", Value: &v}.Validate())
+	assert.NoError(t, Metrics{ID: "yapmetrics", MType: "gauge", Value: &v}.Validate())
+}
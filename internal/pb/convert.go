@@ -0,0 +1,51 @@
+// Package pb содержит gRPC-сервис метрик. metrics.pb.go и metrics_grpc.pb.go
+// генерируются из metrics.proto командой go generate.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
+
+import "github.com/lionslon/go-yapmetrics/internal/models"
+
+func FromModel(m models.Metrics) *Metric {
+	return &Metric{Id: m.ID, Type: m.MType, Delta: m.Delta, Value: m.Value, Labels: m.Labels}
+}
+
+func FromModels(metrics []models.Metrics) []*Metric {
+	result := make([]*Metric, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, FromModel(m))
+	}
+	return result
+}
+
+func (m *Metric) Model() models.Metrics {
+	labels := m.GetLabels()
+	if len(labels) == 0 {
+		labels = nil
+	}
+	return models.Metrics{ID: m.GetId(), MType: m.GetType(), Delta: m.Delta, Value: m.Value, Labels: labels}
+}
+
+func ToModels(metrics []*Metric) []models.Metrics {
+	result := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, m.Model())
+	}
+	return result
+}
+
+func FromBatchErrors(items []models.BatchItemError) []*BatchItemError {
+	result := make([]*BatchItemError, 0, len(items))
+	for _, e := range items {
+		result = append(result, &BatchItemError{Index: int32(e.Index), Id: e.ID, Reason: e.Reason})
+	}
+	return result
+}
+
+func ToBatchErrors(items []*BatchItemError) []models.BatchItemError {
+	result := make([]models.BatchItemError, 0, len(items))
+	for _, e := range items {
+		result = append(result, models.BatchItemError{Index: int(e.GetIndex()), ID: e.GetId(), Reason: e.GetReason()})
+	}
+	return result
+}
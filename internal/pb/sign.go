@@ -0,0 +1,30 @@
+package pb
+
+import (
+	"github.com/lionslon/go-yapmetrics/internal/sign"
+	"google.golang.org/protobuf/proto"
+)
+
+// SignHeader ключ метаданных с подписью сообщения, аналог HTTP-заголовка HashSHA256.
+const SignHeader = "hashsha256"
+
+// RealIPHeader ключ метаданных с адресом агента, аналог HTTP-заголовка X-Real-IP.
+const RealIPHeader = "x-real-ip"
+
+// Sign подписывает детерминированную сериализацию сообщения тем же HMAC-SHA256, что и HTTP API.
+func Sign(msg proto.Message, password string) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return sign.Sum(data, []byte(password)), nil
+}
+
+// ValidSign проверяет подпись signature сообщения msg.
+func ValidSign(msg proto.Message, password string, signature string) bool {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	return sign.Valid(data, []byte(password), signature)
+}
@@ -0,0 +1,59 @@
+package selfmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// Handler отдаёт метрики сервера в текстовом формате Prometheus. Если хранилище
+// недоступно, размер хранилища пропускается, остальные метрики отдаются.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := m.collect(r.Context())
+		if err != nil {
+			logger.FromContext(r.Context()).Warn("cannot count storage series", zap.Error(err))
+		}
+		w.Header().Set("Content-Type", models.PrometheusContentType)
+		writeText(w, families)
+	})
+}
+
+// writeText выводит семейства в текстовом формате Prometheus. Бакеты гистограмм
+// выводятся накопленными, с последним бакетом +Inf.
+func writeText(w io.Writer, families []*family) {
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.sorted() {
+			if f.typ != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, models.FormatLabels(s.labels), models.FormatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, le := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", models.FormatFloat(le)), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, models.FormatLabels(s.labels), models.FormatFloat(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, models.FormatLabels(s.labels), s.count)
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+func withLabel(labels map[string]string, k, v string) string {
+	all := make(map[string]string, len(labels)+1)
+	for lk, lv := range labels {
+		all[lk] = lv
+	}
+	all[k] = v
+	return models.FormatLabels(all)
+}
@@ -0,0 +1,63 @@
+package selfmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Feed раз в interval записывает метрики сервера в st, пока не отменён ctx.
+// Сообщения пишутся в логгер из ctx.
+func (m *Metrics) Feed(ctx context.Context, st storage.MetricsStore, interval time.Duration) {
+	last := make(map[string]float64)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.save(ctx, st, last); err != nil && ctx.Err() == nil {
+				logger.FromContext(ctx).Error("cannot store server metrics", zap.Error(err))
+			}
+		}
+	}
+}
+
+// save записывает снимок метрик в st. Counter записываются приращением с прошлого вызова,
+// last хранит их прошлые значения. У гистограмм сохраняются только _count (counter)
+// и _sum (gauge), бакеты дали бы слишком много серий.
+func (m *Metrics) save(ctx context.Context, st storage.MetricsStore, last map[string]float64) error {
+	families, err := m.collect(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Warn("cannot count storage series", zap.Error(err))
+	}
+	counter := func(key string, v float64) error {
+		delta := int64(v - last[key])
+		last[key] = v
+		return st.UpdateCounter(ctx, key, delta)
+	}
+	for _, f := range families {
+		for _, s := range f.sorted() {
+			switch f.typ {
+			case "counter":
+				err = counter(models.SeriesKey(f.name, s.labels), s.value)
+			case "gauge":
+				err = st.UpdateGauge(ctx, models.SeriesKey(f.name, s.labels), s.value)
+			case "histogram":
+				err = counter(models.SeriesKey(f.name+"_count", s.labels), float64(s.count))
+				if err == nil {
+					err = st.UpdateGauge(ctx, models.SeriesKey(f.name+"_sum", s.labels), s.sum)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
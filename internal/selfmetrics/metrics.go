@@ -0,0 +1,239 @@
+// Package selfmetrics собирает собственные метрики сервера: запросы и их длительность,
+// степень сжатия gzip, ошибки подписи, сохранения на диск и размер хранилища.
+//
+// Метрики отдаются в формате Prometheus на отдельном внутреннем адресе и при желании
+// записываются в хранилище самого сервера. Имена всех метрик начинаются с models.ReservedPrefix,
+// клиенты писать метрики с таким префиксом не могут.
+package selfmetrics
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+)
+
+// storeSizeTTL сколько переиспользуется подсчитанный размер хранилища. Для подсчёта
+// читается список всех серий, у DBStore это полный просмотр таблиц, поэтому он
+// не повторяется на каждом запросе метрик.
+const storeSizeTTL = time.Minute
+
+var (
+	// durationBuckets границы гистограмм длительности в секундах, как у клиента Prometheus по умолчанию.
+	durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	// ratioBuckets границы гистограммы степени сжатия: во сколько раз тело больше сжатого.
+	ratioBuckets = []float64{1, 1.5, 2, 3, 5, 10, 20, 50}
+)
+
+// family метрика со всеми её сериями.
+type family struct {
+	name    string
+	help    string
+	typ     string    // counter, gauge или histogram
+	buckets []float64 // только у histogram
+	series  map[string]*series
+}
+
+// series значения одной серии. У histogram counts хранит число наблюдений в каждом
+// бакете без накопления, накопленные значения считаются при выводе.
+type series struct {
+	labels map[string]string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newFamily(name, typ, help string, buckets []float64) *family {
+	return &family{name: name, help: help, typ: typ, buckets: buckets, series: make(map[string]*series)}
+}
+
+func (f *family) get(labels map[string]string) *series {
+	key := models.FormatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(labels map[string]string, v float64) {
+	f.get(labels).value += v
+}
+
+func (f *family) observe(labels map[string]string, v float64) {
+	s := f.get(labels)
+	s.sum += v
+	s.count++
+	for i, le := range f.buckets {
+		if v <= le {
+			s.counts[i]++
+			return
+		}
+	}
+}
+
+// clone копия семейства, которую можно выводить без блокировки.
+func (f *family) clone() *family {
+	c := newFamily(f.name, f.typ, f.help, f.buckets)
+	for k, s := range f.series {
+		cs := *s
+		cs.counts = append([]uint64(nil), s.counts...)
+		c.series[k] = &cs
+	}
+	return c
+}
+
+// sorted серии, отсортированные по меткам.
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	all := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		all = append(all, f.series[k])
+	}
+	return all
+}
+
+// Metrics собственные метрики сервера. Методы безопасны для конкурентного вызова
+// и ничего не делают у nil, поэтому middleware работают и без метрик.
+type Metrics struct {
+	mu           sync.Mutex
+	store        storage.MetricsStore
+	sizeMu       sync.Mutex // один подсчёт размера хранилища за раз
+	sizes        *family
+	sizedAt      time.Time
+	requests     *family
+	latency      *family
+	gzip         *family
+	signFailures *family
+	dumps        *family
+	dumpErrors   *family
+}
+
+// New создаёт метрики сервера. Размер хранилища st считается при каждом сборе.
+func New(st storage.MetricsStore) *Metrics {
+	p := models.ReservedPrefix
+	return &Metrics{
+		store:        st,
+		requests:     newFamily(p+"requests_total", "counter", "Requests served, by transport, route and status.", nil),
+		latency:      newFamily(p+"request_duration_seconds", "histogram", "Request latency, by transport, route and status.", durationBuckets),
+		gzip:         newFamily(p+"gzip_ratio", "histogram", "Uncompressed to compressed size of gzip request and response bodies.", ratioBuckets),
+		signFailures: newFamily(p+"signature_failures_total", "counter", "Requests rejected because of an invalid HashSHA256 signature.", nil),
+		dumps:        newFamily(p+"dump_duration_seconds", "histogram", "Time spent saving metrics to the storage file.", durationBuckets),
+		dumpErrors:   newFamily(p+"dump_errors_total", "counter", "Failed saves of metrics to the storage file.", nil),
+	}
+}
+
+// ObserveRequest учитывает обработанный запрос. Для gRPC route полное имя метода,
+// а method пустой; status код HTTP или название кода gRPC.
+func (m *Metrics) ObserveRequest(transport, route, method, status string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := map[string]string{"transport": transport, "route": route, "status": status}
+	if method != "" {
+		labels["method"] = method
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.add(labels, 1)
+	m.latency.observe(labels, d.Seconds())
+}
+
+// ObserveGzip учитывает сжатое тело запроса или ответа (direction request или response).
+// Пустые тела не учитываются.
+func (m *Metrics) ObserveGzip(direction string, compressed, uncompressed int64) {
+	if m == nil || compressed <= 0 || uncompressed <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gzip.observe(map[string]string{"direction": direction}, float64(uncompressed)/float64(compressed))
+}
+
+// SignatureFailure учитывает запрос с неверной подписью.
+func (m *Metrics) SignatureFailure(transport string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signFailures.add(map[string]string{"transport": transport}, 1)
+}
+
+// ObserveDump учитывает сохранение метрик на диск, подходит для FileStore.SetDumpObserver.
+func (m *Metrics) ObserveDump(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dumps.observe(nil, d.Seconds())
+	if err != nil {
+		m.dumpErrors.add(nil, 1)
+	}
+}
+
+// collect снимок всех метрик, отсортированный по имени. Ошибка подсчёта размера
+// хранилища возвращается вместе с остальными метриками.
+func (m *Metrics) collect(ctx context.Context) ([]*family, error) {
+	sizes, err := m.storeSizes(ctx)
+
+	m.mu.Lock()
+	all := []*family{sizes}
+	for _, f := range []*family{m.requests, m.latency, m.gzip, m.signFailures, m.dumps, m.dumpErrors} {
+		all = append(all, f.clone())
+	}
+	m.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all, err
+}
+
+// storeSizes число серий хранилища по типу и устареванию. Результат переиспользуется
+// storeSizeTTL; если хранилище недоступно, семейство возвращается без серий.
+func (m *Metrics) storeSizes(ctx context.Context) (*family, error) {
+	m.sizeMu.Lock()
+	defer m.sizeMu.Unlock()
+	if m.sizes != nil && time.Since(m.sizedAt) < storeSizeTTL {
+		return m.sizes.clone(), nil
+	}
+
+	sizes := newFamily(models.ReservedPrefix+"store_series", "gauge", "Series in the storage, by type and staleness.", nil)
+	list, err := m.store.List(ctx)
+	if err != nil {
+		return sizes, err
+	}
+	sizes.add(map[string]string{"type": "gauge", "stale": "false"}, 0)
+	sizes.add(map[string]string{"type": "counter", "stale": "false"}, 0)
+	for _, metric := range list {
+		sizes.add(map[string]string{"type": metric.MType, "stale": strconv.FormatBool(metric.Stale)}, 1)
+	}
+	m.sizes, m.sizedAt = sizes, time.Now()
+	return sizes.clone(), nil
+}
+
+type metricsKey struct{}
+
+// WithContext возвращает context с метриками m, из него их берут middleware и перехватчики gRPC.
+func WithContext(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// FromContext метрики из context или nil.
+func FromContext(ctx context.Context) *Metrics {
+	m, _ := ctx.Value(metricsKey{}).(*Metrics)
+	return m
+}
@@ -0,0 +1,118 @@
+package selfmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/lionslon/go-yapmetrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	st := storage.NewMem()
+	require.NoError(t, st.UpdateGauge(context.Background(), "Alloc", 1))
+	m := New(st)
+	m.ObserveRequest("http", "/update/", "POST", "200", 3*time.Millisecond)
+	m.ObserveRequest("http", "/update/", "POST", "200", 2*time.Second)
+	m.ObserveGzip("request", 100, 400)
+	m.ObserveGzip("response", 10, 0)
+	m.SignatureFailure("grpc")
+	m.ObserveDump(time.Millisecond, errors.New("disk full"))
+
+	text := scrape(t, m)
+	for _, line := range []string{
+		"# TYPE yapmetrics_requests_total counter",
+		`yapmetrics_requests_total{method="POST",route="/update/",status="200",transport="http"} 2`,
+		"# TYPE yapmetrics_request_duration_seconds histogram",
+		`yapmetrics_request_duration_seconds_bucket{le="0.001",method="POST",route="/update/",status="200",transport="http"} 0`,
+		`yapmetrics_request_duration_seconds_bucket{le="0.005",method="POST",route="/update/",status="200",transport="http"} 1`,
+		`yapmetrics_request_duration_seconds_bucket{le="2.5",method="POST",route="/update/",status="200",transport="http"} 2`,
+		`yapmetrics_request_duration_seconds_bucket{le="+Inf",method="POST",route="/update/",status="200",transport="http"} 2`,
+		`yapmetrics_request_duration_seconds_sum{method="POST",route="/update/",status="200",transport="http"} 2.003`,
+		`yapmetrics_request_duration_seconds_count{method="POST",route="/update/",status="200",transport="http"} 2`,
+		`yapmetrics_gzip_ratio_count{direction="request"} 1`,
+		`yapmetrics_signature_failures_total{transport="grpc"} 1`,
+		`yapmetrics_dump_duration_seconds_count 1`,
+		`yapmetrics_dump_errors_total 1`,
+		`yapmetrics_store_series{stale="false",type="gauge"} 1`,
+		`yapmetrics_store_series{stale="false",type="counter"} 0`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+	assert.NotContains(t, text, `direction="response"`, "empty bodies must not be counted")
+}
+
+type countingStore struct {
+	*storage.MemStorage
+	lists int
+}
+
+func (s *countingStore) List(ctx context.Context) ([]models.Metrics, error) {
+	s.lists++
+	return s.MemStorage.List(ctx)
+}
+
+func TestStoreSizeIsCached(t *testing.T) {
+	st := &countingStore{MemStorage: storage.NewMem()}
+	require.NoError(t, st.UpdateGauge(context.Background(), "Alloc", 1))
+	m := New(st)
+
+	assert.Contains(t, scrape(t, m), `yapmetrics_store_series{stale="false",type="gauge"} 1`)
+	require.NoError(t, st.UpdateGauge(context.Background(), "Sys", 1))
+	assert.Contains(t, scrape(t, m), `yapmetrics_store_series{stale="false",type="gauge"} 1`)
+	assert.Equal(t, 1, st.lists, "scrapes must not list the whole storage every time")
+
+	m.sizedAt = time.Now().Add(-storeSizeTTL)
+	assert.Contains(t, scrape(t, m), `yapmetrics_store_series{stale="false",type="gauge"} 2`)
+	assert.Equal(t, 2, st.lists)
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.ObserveRequest("http", "/", "GET", "200", time.Second)
+		m.ObserveGzip("response", 1, 2)
+		m.SignatureFailure("http")
+		m.ObserveDump(time.Second, nil)
+	})
+	assert.Nil(t, FromContext(context.Background()))
+}
+
+func TestSaveWritesCounterDeltas(t *testing.T) {
+	ctx := context.Background()
+	st := storage.NewMem()
+	m := New(st)
+	last := make(map[string]float64)
+
+	m.SignatureFailure("http")
+	m.SignatureFailure("http")
+	require.NoError(t, m.save(ctx, st, last))
+	m.SignatureFailure("http")
+	m.ObserveDump(2*time.Second, nil)
+	require.NoError(t, m.save(ctx, st, last))
+
+	failures, err := st.GetCounterValue(ctx, `yapmetrics_signature_failures_total{transport="http"}`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), failures, "counters must not be added twice")
+	dumps, err := st.GetCounterValue(ctx, "yapmetrics_dump_duration_seconds_count")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), dumps)
+	sum, err := st.GetGaugeValue(ctx, "yapmetrics_dump_duration_seconds_sum")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, sum)
+	_, err = st.GetCounterValue(ctx, "yapmetrics_dump_duration_seconds_bucket")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
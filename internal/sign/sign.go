@@ -0,0 +1,32 @@
+// Package sign подписывает данные HMAC-SHA256 общим ключом -k. Подписью пользуются
+// HTTP API (заголовок HashSHA256), gRPC API (метаданные hashsha256) и агент.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Sum подпись data ключом pass в шестнадцатеричном виде.
+func Sum(data []byte, pass []byte) string {
+	hashValue := hmac.New(sha256.New, pass)
+	hashValue.Write(data)
+	return hex.EncodeToString(hashValue.Sum(nil))
+}
+
+// Valid проверяет подпись s данных data без утечки времени сравнения.
+func Valid(data []byte, pass []byte, s string) bool {
+	return hmac.Equal([]byte(Sum(data, pass)), []byte(s))
+}
+
+// Target данные, которые подписываются в запросах на удаление и сброс:
+// метод, путь с параметрами запроса и тело, разделённые переводом строки.
+func Target(method, requestURI string, body []byte) []byte {
+	data := make([]byte, 0, len(method)+len(requestURI)+len(body)+2)
+	data = append(data, method...)
+	data = append(data, '\n')
+	data = append(data, requestURI...)
+	data = append(data, '\n')
+	return append(data, body...)
+}
@@ -0,0 +1,19 @@
+package sign
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSum(t *testing.T) {
+	// Значение из RFC 4231, тестовый случай 2.
+	assert.Equal(t, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		Sum([]byte("what do ya want for nothing?"), []byte("Jefe")))
+	assert.True(t, Valid([]byte("body"), []byte("secret"), Sum([]byte("body"), []byte("secret"))))
+	assert.False(t, Valid([]byte("body"), []byte("other"), Sum([]byte("body"), []byte("secret"))))
+}
+
+func TestTarget(t *testing.T) {
+	assert.Equal(t, "DELETE\n/value/gauge/Alloc?host=a\n", string(Target("DELETE", "/value/gauge/Alloc?host=a", nil)))
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+)
+
+// RollupTier уровень предагрегации: для каждой серии хранится статистика за окна
+// длиной Resolution, не больше Size последних окон.
+type RollupTier struct {
+	Name       string
+	Resolution time.Duration
+	Size       int
+}
+
+// span за какой период уровень хранит данные.
+func (t RollupTier) span() time.Duration {
+	return t.Resolution * time.Duration(t.Size)
+}
+
+// QueryRange окна запроса: [From, To) делится на окна длиной Step, начиная с From.
+// Quantiles значения от 0 до 1, которые нужно посчитать в каждом окне.
+type QueryRange struct {
+	From      time.Time
+	To        time.Time
+	Step      time.Duration
+	Quantiles []float64
+}
+
+// Aggregation результат Aggregate: непустые окна по порядку и источник данных,
+// "raw" для истории или имя уровня предагрегации.
+type Aggregation struct {
+	Source  string
+	Buckets []models.Bucket
+}
+
+const rawSource = "raw"
+
+// pickTier выбирает самый грубый уровень, окна которого целиком укладываются в шаг запроса
+// и который ещё хранит начало интервала. Квантили по предагрегации не посчитать,
+// поэтому для них всегда берётся история. -1 означает историю.
+func pickTier(tiers []RollupTier, r QueryRange, now time.Time) int {
+	if len(r.Quantiles) > 0 {
+		return -1
+	}
+	best := -1
+	for i, t := range tiers {
+		if t.Resolution <= 0 || r.Step%t.Resolution != 0 || now.Sub(r.From) > t.span() {
+			continue
+		}
+		if best < 0 || t.Resolution > tiers[best].Resolution {
+			best = i
+		}
+	}
+	return best
+}
+
+// bucketer раскладывает упорядоченные по времени значения или окна предагрегации
+// по окнам запроса.
+type bucketer struct {
+	r       QueryRange
+	buckets []models.Bucket
+	idx     int64
+	values  []float64
+}
+
+func newBucketer(r QueryRange) *bucketer {
+	return &bucketer{r: r, buckets: make([]models.Bucket, 0), idx: -1}
+}
+
+// add учитывает статистику st, относящуюся к моменту t. Значения вне [From, To) пропускаются.
+func (b *bucketer) add(t time.Time, st models.Bucket) {
+	if t.Before(b.r.From) || !t.Before(b.r.To) {
+		return
+	}
+	idx := int64(t.Sub(b.r.From) / b.r.Step)
+	if idx != b.idx {
+		b.flush()
+		b.idx = idx
+		b.buckets = append(b.buckets, models.Bucket{
+			Start: b.r.From.Add(time.Duration(idx) * b.r.Step),
+			Min:   math.Inf(1),
+			Max:   math.Inf(-1),
+			First: st.First,
+		})
+	}
+	cur := &b.buckets[len(b.buckets)-1]
+	cur.Count += st.Count
+	cur.Sum += st.Sum
+	cur.Min = math.Min(cur.Min, st.Min)
+	cur.Max = math.Max(cur.Max, st.Max)
+	cur.Last = st.Last
+	if len(b.r.Quantiles) > 0 {
+		b.values = append(b.values, st.Last)
+	}
+}
+
+func (b *bucketer) addSample(s models.Sample) {
+	b.add(s.Time, sampleBucket(s))
+}
+
+func (b *bucketer) flush() {
+	if len(b.buckets) == 0 || len(b.r.Quantiles) == 0 {
+		return
+	}
+	sort.Float64s(b.values)
+	cur := &b.buckets[len(b.buckets)-1]
+	cur.Quantiles = make([]float64, len(b.r.Quantiles))
+	for i, q := range b.r.Quantiles {
+		cur.Quantiles[i] = quantile(b.values, q)
+	}
+	b.values = b.values[:0]
+}
+
+func (b *bucketer) result() []models.Bucket {
+	b.flush()
+	return b.buckets
+}
+
+func sampleBucket(s models.Sample) models.Bucket {
+	return models.Bucket{Start: s.Time, Count: 1, Sum: s.Value, Min: s.Value, Max: s.Value, First: s.Value, Last: s.Value}
+}
+
+// quantile считает квантиль q отсортированных значений с линейной интерполяцией,
+// как percentile_cont в PostgreSQL.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := q * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
+
+// rollup кольцевой буфер окон одного уровня предагрегации.
+type rollup struct {
+	buckets []models.Bucket
+	next    int
+}
+
+// add добавляет значение в текущее окно или начинает новое. Значения старше
+// последнего окна пропускаются: хранилище пишет их в порядке времени.
+func (r *rollup) add(s models.Sample, t RollupTier) {
+	start := s.Time.Truncate(t.Resolution)
+	if n := len(r.buckets); n > 0 {
+		last := &r.buckets[(r.next+n-1)%n]
+		if start.Equal(last.Start) {
+			last.Count++
+			last.Sum += s.Value
+			last.Min = math.Min(last.Min, s.Value)
+			last.Max = math.Max(last.Max, s.Value)
+			last.Last = s.Value
+			return
+		}
+		if start.Before(last.Start) {
+			return
+		}
+	}
+	b := sampleBucket(s)
+	b.Start = start
+	if len(r.buckets) < t.Size {
+		r.buckets = append(r.buckets, b)
+		return
+	}
+	r.buckets[r.next] = b
+	r.next = (r.next + 1) % len(r.buckets)
+}
+
+func (r *rollup) each(fn func(models.Bucket)) {
+	for i := range r.buckets {
+		fn(r.buckets[(r.next+i)%len(r.buckets)])
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketerQuantiles(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := QueryRange{From: from, To: from.Add(2 * time.Minute), Step: time.Minute, Quantiles: []float64{0.5, 0.9}}
+	b := newBucketer(r)
+	for i, v := range []float64{4, 1, 3, 2} {
+		b.addSample(models.Sample{Time: from.Add(time.Duration(i) * time.Second), Value: v})
+	}
+	b.addSample(models.Sample{Time: from.Add(90 * time.Second), Value: 10})
+	b.addSample(models.Sample{Time: from.Add(3 * time.Minute), Value: 100})
+
+	buckets := b.result()
+	require.Len(t, buckets, 2)
+	assert.Equal(t, models.Bucket{Start: from, Count: 4, Sum: 10, Min: 1, Max: 4, First: 4, Last: 2, Quantiles: []float64{2.5, 3.7}}, roundQuantiles(buckets[0]))
+	assert.Equal(t, from.Add(time.Minute), buckets[1].Start)
+	assert.Equal(t, []float64{10, 10}, buckets[1].Quantiles)
+}
+
+// testHistory история с уровнями предагрегации по умолчанию, сами хранилища создаются без неё.
+var testHistory = HistoryConfig{Size: 100, Retention: 24 * time.Hour, Rollups: DefaultRollups}
+
+func TestPickTier(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tiers := DefaultRollups
+	tests := []struct {
+		name string
+		r    QueryRange
+		want int
+	}{
+		{name: "step below every tier", r: QueryRange{From: now.Add(-time.Hour), Step: 30 * time.Second}, want: -1},
+		{name: "minute tier", r: QueryRange{From: now.Add(-time.Hour), Step: 5 * time.Minute}, want: 0},
+		{name: "hour tier is coarser", r: QueryRange{From: now.Add(-time.Hour), Step: 2 * time.Hour}, want: 1},
+		{name: "minute tier does not reach back", r: QueryRange{From: now.Add(-48 * time.Hour), Step: 5 * time.Minute}, want: -1},
+		{name: "quantiles need raw samples", r: QueryRange{From: now.Add(-time.Hour), Step: time.Hour, Quantiles: []float64{0.5}}, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, pickTier(tiers, tt.r, now))
+		})
+	}
+}
+
+func TestMemStorageAggregateUsesRollups(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetHistory(testHistory)
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, s.UpdateCounter(ctx, "PollCount", int64(i)))
+	}
+
+	now := time.Now()
+	r := QueryRange{From: now.Add(-time.Hour).Truncate(time.Hour), To: now.Add(time.Hour), Step: time.Hour}
+	agg, err := s.Aggregate(ctx, "counter", "PollCount", r)
+	require.NoError(t, err)
+	assert.Equal(t, "1h", agg.Source)
+	require.Len(t, agg.Buckets, 1)
+	b := agg.Buckets[0]
+	assert.Equal(t, int64(4), b.Count)
+	assert.Equal(t, 1.0, b.Min)
+	assert.Equal(t, 10.0, b.Max)
+	assert.Equal(t, 20.0, b.Sum, "running totals 1, 3, 6, 10")
+
+	r.Quantiles = []float64{0.5}
+	agg, err = s.Aggregate(ctx, "counter", "PollCount", r)
+	require.NoError(t, err)
+	assert.Equal(t, "raw", agg.Source)
+	assert.Equal(t, []float64{4.5}, agg.Buckets[0].Quantiles)
+
+	_, err = s.Aggregate(ctx, "gauge", "PollCount", r)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRollupRing(t *testing.T) {
+	tier := RollupTier{Name: "1m", Resolution: time.Minute, Size: 2}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var r rollup
+	for i := 0; i < 6; i++ {
+		r.add(models.Sample{Time: start.Add(time.Duration(i) * 30 * time.Second), Value: float64(i)}, tier)
+	}
+	r.add(models.Sample{Time: start, Value: 100}, tier)
+
+	var got []models.Bucket
+	r.each(func(b models.Bucket) { got = append(got, b) })
+	require.Len(t, got, 2)
+	assert.Equal(t, models.Bucket{Start: start.Add(time.Minute), Count: 2, Sum: 5, Min: 2, Max: 3, First: 2, Last: 3}, got[0])
+	assert.Equal(t, start.Add(2*time.Minute), got[1].Start)
+}
+
+func roundQuantiles(b models.Bucket) models.Bucket {
+	for i, q := range b.Quantiles {
+		b.Quantiles[i] = float64(int(q*1000+0.5)) / 1000
+	}
+	return b
+}
@@ -2,144 +2,605 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/lionslon/go-yapmetrics/internal/migrations"
+	"github.com/lionslon/go-yapmetrics/internal/models"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"time"
 )
 
-type DBConnection struct {
-	DB *sqlx.DB
-}
+const (
+	upsertCounterQuery = "INSERT INTO counter_metrics (name, labels, value) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value, updated_at = now();"
+	upsertGaugeQuery = "INSERT INTO gauge_metrics (name, labels, value) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value, updated_at = now();"
+
+	// Варианты upsert, которые в том же запросе дописывают новое значение серии в историю.
+	upsertCounterHistoryQuery = "WITH m AS (INSERT INTO counter_metrics (name, labels, value) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (name, labels) DO UPDATE SET value = counter_metrics.value + EXCLUDED.value, updated_at = now() " +
+		"RETURNING name, labels, value) " +
+		"INSERT INTO metric_history (mtype, name, labels, value) SELECT 'counter', name, labels, value FROM m;"
+	upsertGaugeHistoryQuery = "WITH m AS (INSERT INTO gauge_metrics (name, labels, value) VALUES ($1, $2, $3) " +
+		"ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value, updated_at = now() " +
+		"RETURNING name, labels, value) " +
+		"INSERT INTO metric_history (mtype, name, labels, value) SELECT 'gauge', name, labels, value FROM m;"
+
+	historyQuery = "SELECT value, recorded_at FROM metric_history " +
+		"WHERE mtype = $1 AND name = $2 AND labels = $3 " +
+		"AND ($4::timestamptz IS NULL OR recorded_at >= $4) AND ($5::timestamptz IS NULL OR recorded_at <= $5) " +
+		"ORDER BY recorded_at, id;"
+
+	// pruneHistoryQuery оставляет у каждой серии не больше $1 последних значений не старше $2.
+	pruneHistoryQuery = "DELETE FROM metric_history WHERE id IN (" +
+		"SELECT id FROM (SELECT id, recorded_at, row_number() OVER " +
+		"(PARTITION BY mtype, name, labels ORDER BY recorded_at DESC, id DESC) AS rn FROM metric_history) h " +
+		"WHERE rn > $1 OR recorded_at < $2);"
+
+	// deleteSeriesQuery удаляет из таблицы последних значений %[1]s серии, подходящие под
+	// условие %[2]s, вместе с их историей и предагрегацией и возвращает число удалённых серий.
+	// Тип метрики передаётся в $1, параметры условия начинаются с $2.
+	deleteSeriesQuery = "WITH d AS (DELETE FROM %[1]s WHERE %[2]s RETURNING name, labels), " +
+		"h AS (DELETE FROM metric_history m USING d WHERE m.mtype = $1 AND m.name = d.name AND m.labels = d.labels), " +
+		"r AS (DELETE FROM metric_rollups m USING d WHERE m.mtype = $1 AND m.name = d.name AND m.labels = d.labels) " +
+		"SELECT count(*) FROM d;"
+	purgeStaleCond   = "updated_at < $2"
+	deleteSeriesCond = "name = $2 AND labels = $3"
+	deletePrefixCond = "left(name, length($2)) = $2"
+
+	resetCounterQuery = "UPDATE counter_metrics SET value = 0, updated_at = now() WHERE name = $1 AND labels = $2;"
+	// resetCounterHistoryQuery сбрасывает счётчик и дописывает ноль в историю.
+	resetCounterHistoryQuery = "WITH m AS (UPDATE counter_metrics SET value = 0, updated_at = now() " +
+		"WHERE name = $1 AND labels = $2 RETURNING name, labels, value) " +
+		"INSERT INTO metric_history (mtype, name, labels, value) SELECT 'counter', name, labels, value FROM m;"
+)
+
+// Запросы /query. Окно значения считается от $4 с шагом $6 секунд.
+const (
+	aggregateHistoryQuery = "SELECT floor(extract(epoch FROM recorded_at - $4::timestamptz) / $6::float8)::bigint AS b, " +
+		"count(*), sum(value), min(value), max(value), " +
+		"(array_agg(value ORDER BY recorded_at, id))[1], (array_agg(value ORDER BY recorded_at DESC, id DESC))[1], " +
+		"percentile_cont($7::float8[]) WITHIN GROUP (ORDER BY value) " +
+		"FROM metric_history WHERE mtype = $1 AND name = $2 AND labels = $3 " +
+		"AND recorded_at >= $8 AND recorded_at < $5 GROUP BY b ORDER BY b;"
+	aggregateRollupQuery = "SELECT floor(extract(epoch FROM bucket_start - $4::timestamptz) / $6::float8)::bigint AS b, " +
+		"sum(count)::bigint, sum(sum), min(min), max(max), " +
+		"(array_agg(first ORDER BY bucket_start))[1], (array_agg(last ORDER BY bucket_start DESC))[1] " +
+		"FROM metric_rollups WHERE resolution = $7 AND mtype = $1 AND name = $2 AND labels = $3 " +
+		"AND bucket_start >= $4 AND bucket_start < $5 GROUP BY b ORDER BY b;"
+
+	// rollupQuery пересчитывает из истории окна уровня длиной $1 секунд, начиная с $2.
+	rollupQuery = "INSERT INTO metric_rollups (resolution, mtype, name, labels, bucket_start, count, sum, min, max, first, last) " +
+		"SELECT $1::integer, mtype, name, labels, " +
+		"to_timestamp((floor(extract(epoch FROM recorded_at) / $1::integer) * $1::integer)::float8) AS b, " +
+		"count(*), sum(value), min(value), max(value), " +
+		"(array_agg(value ORDER BY recorded_at, id))[1], (array_agg(value ORDER BY recorded_at DESC, id DESC))[1] " +
+		"FROM metric_history WHERE recorded_at >= $2 GROUP BY mtype, name, labels, b " +
+		"ON CONFLICT (resolution, mtype, name, labels, bucket_start) DO UPDATE SET count = EXCLUDED.count, " +
+		"sum = EXCLUDED.sum, min = EXCLUDED.min, max = EXCLUDED.max, first = EXCLUDED.first, last = EXCLUDED.last;"
+	pruneRollupsQuery = "DELETE FROM metric_rollups WHERE resolution = $1 AND bucket_start < $2;"
+)
+
+// historyPruneInterval как часто DBStore обновляет предагрегацию и удаляет из истории
+// значения сверх ограничений. На столько же предагрегация может отставать от истории.
+const historyPruneInterval = time.Minute
 
 type counterMetric struct {
-	name  string
-	value int64
+	name      string
+	labels    string
+	value     int64
+	updatedAt time.Time
 }
 
 type gaugeMetric struct {
-	name  string
-	value float64
+	name      string
+	labels    string
+	value     float64
+	updatedAt time.Time
 }
 
-type dbProvider struct {
-	st            *MemStorage
-	DB            *sqlx.DB
-	storeInterval int
+// DBStore хранит метрики напрямую в PostgreSQL, без промежуточной копии в памяти.
+// Каждое обновление сразу записывается в базу через INSERT ... ON CONFLICT DO UPDATE,
+// счётчики складываются на стороне базы, поэтому параллельные запросы не теряют приращения.
+// История пишется в metric_history тем же запросом, а ограничения HistoryConfig
+// применяются периодически в IntervalPrune.
+type DBStore struct {
+	DB      *sqlx.DB
+	history HistoryConfig
+	ttl     time.Duration
+	log     *zap.Logger
 }
 
-func NewDBProvider(dsn string, storeInterval int, m *MemStorage) (StorageWorker, error) {
-	var err error
-	dbc := &dbProvider{
-		st:            m,
-		storeInterval: storeInterval,
+func NewDBStore(dsn string, log *zap.Logger) (*DBStore, error) {
+	if dsn == "" {
+		return nil, errors.New("Empty dsn string")
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
 	}
 
-	if dsn == "" {
-		return dbc, errors.New("Empty dsn string")
+	m, err := migrations.New(db.DB)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if applied > 0 {
+		log.Info("applied database migrations", zap.Int("applied", applied), zap.Int("version", m.Latest()))
+	}
+	return &DBStore{DB: db, history: DefaultHistory, log: log}, nil
+}
+
+// SetHistory меняет ограничения истории. Вызывается до начала обработки запросов.
+func (d *DBStore) SetHistory(cfg HistoryConfig) {
+	d.history = cfg
+}
+
+// SetTTL задаёт, через сколько после последнего обновления серия считается устаревшей.
+// 0 отключает отметку устаревших серий.
+func (d *DBStore) SetTTL(ttl time.Duration) {
+	d.ttl = ttl
+}
+
+func (d *DBStore) counterQuery() string {
+	if d.history.enabled() {
+		return upsertCounterHistoryQuery
+	}
+	return upsertCounterQuery
+}
+
+func (d *DBStore) gaugeQuery() string {
+	if d.history.enabled() {
+		return upsertGaugeHistoryQuery
+	}
+	return upsertGaugeQuery
+}
+
+// metricTables таблицы последних значений по типу метрики.
+var metricTables = map[string]string{"counter": "counter_metrics", "gauge": "gauge_metrics"}
+
+// seriesColumns раскладывает ключ серии на значения колонок name и labels.
+// Метки хранятся в jsonb, у серии без меток это пустой объект.
+func seriesColumns(key string) (string, string, error) {
+	name, labels, err := models.ParseSeriesKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return name, labelsJSON(labels), nil
+}
+
+func labelsJSON(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+func (d *DBStore) UpdateCounter(ctx context.Context, key string, delta int64) error {
+	name, labels, err := seriesColumns(key)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB.ExecContext(ctx, d.counterQuery(), name, labels, delta)
+	return err
+}
+
+func (d *DBStore) UpdateGauge(ctx context.Context, key string, value float64) error {
+	name, labels, err := seriesColumns(key)
+	if err != nil {
+		return err
+	}
+	_, err = d.DB.ExecContext(ctx, d.gaugeQuery(), name, labels, value)
+	return err
+}
+
+func (d *DBStore) GetCounterValue(ctx context.Context, key string) (int64, error) {
+	name, labels, err := seriesColumns(key)
+	if err != nil {
+		return 0, err
+	}
+	var v int64
+	err = d.DB.QueryRowContext(ctx, "SELECT value FROM counter_metrics WHERE name = $1 AND labels = $2;", name, labels).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
 	}
-	dbc.DB, err = sqlx.Open("postgres", dsn)
+	return v, err
+}
+
+func (d *DBStore) GetGaugeValue(ctx context.Context, key string) (float64, error) {
+	name, labels, err := seriesColumns(key)
 	if err != nil {
-		return dbc, err
+		return 0, err
+	}
+	var v float64
+	err = d.DB.QueryRowContext(ctx, "SELECT value FROM gauge_metrics WHERE name = $1 AND labels = $2;", name, labels).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
 	}
+	return v, err
+}
 
-	if dbc.DB != nil {
-		_, err := dbc.DB.Exec("CREATE TABLE IF NOT EXISTS counter_metrics (name char(30) UNIQUE, value integer);")
+// StoreBatch записывает пакет одной транзакцией. Приращения одного счётчика и повторы
+// одной gauge-метрики сначала сворачиваются, затем строки пишутся подготовленными запросами.
+// Некорректный пакет отклоняется целиком с *BatchError ещё до начала транзакции.
+func (d *DBStore) StoreBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := ValidateBatch(metrics); err != nil {
+		return err
+	}
+	counters, gauges := collapseBatch(metrics)
+	if len(counters) == 0 && len(gauges) == 0 {
+		return nil
+	}
+
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(counters) > 0 {
+		stmt, err := tx.PrepareContext(ctx, d.counterQuery())
 		if err != nil {
-			return nil, err
+			return err
+		}
+		defer stmt.Close()
+		for _, cm := range counters {
+			if _, err := stmt.ExecContext(ctx, cm.name, cm.labels, cm.value); err != nil {
+				return err
+			}
 		}
-		_, err = dbc.DB.Exec("CREATE TABLE IF NOT EXISTS gauge_metrics (name char(30) UNIQUE, value double precision);")
+	}
+
+	if len(gauges) > 0 {
+		stmt, err := tx.PrepareContext(ctx, d.gaugeQuery())
 		if err != nil {
-			return nil, err
+			return err
+		}
+		defer stmt.Close()
+		for _, gm := range gauges {
+			if _, err := stmt.ExecContext(ctx, gm.name, gm.labels, gm.value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// collapseBatch суммирует приращения счётчиков и оставляет последнее значение gauge,
+// сохраняя порядок первого появления метрики в пакете.
+func collapseBatch(metrics []models.Metrics) ([]counterMetric, []gaugeMetric) {
+	counters := make([]counterMetric, 0)
+	gauges := make([]gaugeMetric, 0)
+	counterIdx := make(map[string]int)
+	gaugeIdx := make(map[string]int)
+
+	for _, m := range metrics {
+		key := m.Key()
+		switch m.MType {
+		case "counter":
+			if i, ok := counterIdx[key]; ok {
+				counters[i].value += *m.Delta
+				continue
+			}
+			counterIdx[key] = len(counters)
+			counters = append(counters, counterMetric{name: m.ID, labels: labelsJSON(m.Labels), value: *m.Delta})
+		case "gauge":
+			if i, ok := gaugeIdx[key]; ok {
+				gauges[i].value = *m.Value
+				continue
+			}
+			gaugeIdx[key] = len(gauges)
+			gauges = append(gauges, gaugeMetric{name: m.ID, labels: labelsJSON(m.Labels), value: *m.Value})
 		}
 	}
-	return dbc, nil
+	return counters, gauges
 }
 
-func (d *dbProvider) Restore() error {
-	ctx := context.Background()
-	rowsCounter, err := d.DB.QueryContext(ctx, "SELECT name, value FROM counter_metrics;")
+func (d *DBStore) List(ctx context.Context) ([]models.Metrics, error) {
+	result := make([]models.Metrics, 0)
+
+	rowsGauge, err := d.DB.QueryContext(ctx, "SELECT name, labels, value, updated_at FROM gauge_metrics;")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := rowsCounter.Err(); err != nil {
-		return err
+	defer rowsGauge.Close()
+	for rowsGauge.Next() {
+		var gm gaugeMetric
+		if err := rowsGauge.Scan(&gm.name, &gm.labels, &gm.value, &gm.updatedAt); err != nil {
+			return nil, err
+		}
+		labels, err := parseLabels(gm.labels)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, models.Metrics{ID: gm.name, MType: "gauge", Value: &gm.value, Labels: labels, UpdatedAt: gm.updatedAt})
+	}
+	if err := rowsGauge.Err(); err != nil {
+		return nil, err
 	}
-	defer rowsCounter.Close()
 
+	rowsCounter, err := d.DB.QueryContext(ctx, "SELECT name, labels, value, updated_at FROM counter_metrics;")
+	if err != nil {
+		return nil, err
+	}
+	defer rowsCounter.Close()
 	for rowsCounter.Next() {
 		var cm counterMetric
-		err = rowsCounter.Scan(&cm.name, &cm.value)
+		if err := rowsCounter.Scan(&cm.name, &cm.labels, &cm.value, &cm.updatedAt); err != nil {
+			return nil, err
+		}
+		labels, err := parseLabels(cm.labels)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		d.st.UpdateCounter(cm.name, cm.value)
+		result = append(result, models.Metrics{ID: cm.name, MType: "counter", Delta: &cm.value, Labels: labels, UpdatedAt: cm.updatedAt})
+	}
+	if err := rowsCounter.Err(); err != nil {
+		return nil, err
 	}
 
-	rowsGauge, err := d.DB.QueryContext(ctx, "SELECT name, value FROM gauge_metrics;")
+	sortMetrics(result)
+	markStale(result, d.ttl, time.Now())
+	return result, nil
+}
+
+// PurgeStale удаляет серии обоих типов, которые не обновлялись с before, в одной транзакции.
+func (d *DBStore) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	return d.deleteSeries(ctx, []string{"gauge", "counter"}, purgeStaleCond, before)
+}
+
+// Delete удаляет серию вместе с её историей.
+func (d *DBStore) Delete(ctx context.Context, mType, key string) error {
+	if _, ok := metricTables[mType]; !ok {
+		return ErrNotFound
+	}
+	name, labels, err := seriesColumns(key)
 	if err != nil {
 		return err
 	}
-	if err := rowsGauge.Err(); err != nil {
+	n, err := d.deleteSeries(ctx, []string{mType}, deleteSeriesCond, name, labels)
+	if err != nil {
 		return err
 	}
-	defer rowsGauge.Close()
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
 
-	for rowsGauge.Next() {
-		var gm gaugeMetric
-		err = rowsGauge.Scan(&gm.name, &gm.value)
-		if err != nil {
-			return err
+// DeletePrefix удаляет серии обоих типов, имя которых начинается с prefix.
+func (d *DBStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	return d.deleteSeries(ctx, []string{"gauge", "counter"}, deletePrefixCond, prefix)
+}
+
+// deleteSeries выполняет deleteSeriesQuery с условием cond для каждого типа из mTypes в одной транзакции.
+func (d *DBStore) deleteSeries(ctx context.Context, mTypes []string, cond string, args ...any) (int, error) {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	deleted := 0
+	for _, mType := range mTypes {
+		var n int
+		query := fmt.Sprintf(deleteSeriesQuery, metricTables[mType], cond)
+		if err := tx.QueryRowContext(ctx, query, append([]any{mType}, args...)...).Scan(&n); err != nil {
+			return 0, fmt.Errorf("delete %s metrics: %w", mType, err)
 		}
-		d.st.UpdateGauge(gm.name, gm.value)
+		deleted += n
+	}
+	return deleted, tx.Commit()
+}
+
+// ResetCounter обнуляет счётчик. Если история включена, в неё попадает нулевое значение.
+func (d *DBStore) ResetCounter(ctx context.Context, key string) error {
+	name, labels, err := seriesColumns(key)
+	if err != nil {
+		return err
+	}
+	query := resetCounterQuery
+	if d.history.enabled() {
+		query = resetCounterHistoryQuery
+	}
+	res, err := d.DB.ExecContext(ctx, query, name, labels)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
 
-func (d *dbProvider) IntervalDump() {
-	pollTicker := time.NewTicker(time.Duration(d.storeInterval) * time.Second)
-	defer pollTicker.Stop()
-	for range pollTicker.C {
-		err := d.Dump()
-		if err != nil {
-			zap.S().Error(err)
+// History возвращает значения серии из [from, to], но не старше Retention.
+func (d *DBStore) History(ctx context.Context, mType, key string, from, to time.Time) ([]models.Sample, error) {
+	table, ok := metricTables[mType]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	name, labels, err := seriesColumns(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.checkHistory(ctx, table, name, labels); err != nil {
+		return nil, err
+	}
+
+	from = d.history.since(from, time.Now())
+	rows, err := d.DB.QueryContext(ctx, historyQuery, mType, name, labels, nullTime(from), nullTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]models.Sample, 0)
+	for rows.Next() {
+		var s models.Sample
+		if err := rows.Scan(&s.Value, &s.Time); err != nil {
+			return nil, err
 		}
+		result = append(result, s)
 	}
+	return result, rows.Err()
 }
 
-func (d *dbProvider) Check() error {
-	err := d.DB.Ping()
+// checkHistory возвращает ErrNotFound, если серии нет в table, и ErrNotSupported, если история отключена.
+func (d *DBStore) checkHistory(ctx context.Context, table, name, labels string) error {
+	var exists bool
+	err := d.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+" WHERE name = $1 AND labels = $2);", name, labels).Scan(&exists)
 	if err != nil {
-		return errors.New("Empty connection string")
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	if !d.history.enabled() {
+		return ErrNotSupported
 	}
 	return nil
 }
 
-func (d *dbProvider) Dump() error {
-	tx, err := d.DB.Begin()
+// Aggregate считает статистику серии по окнам r: по уровню предагрегации, если он подходит,
+// иначе по истории. Квантили считаются в базе через percentile_cont.
+func (d *DBStore) Aggregate(ctx context.Context, mType, key string, r QueryRange) (Aggregation, error) {
+	table, ok := metricTables[mType]
+	if !ok {
+		return Aggregation{}, ErrNotFound
+	}
+	name, labels, err := seriesColumns(key)
 	if err != nil {
-		return err
+		return Aggregation{}, err
+	}
+	if err := d.checkHistory(ctx, table, name, labels); err != nil {
+		return Aggregation{}, err
 	}
 
-	_, err = tx.Exec("TRUNCATE counter_metrics, gauge_metrics; ")
+	now := time.Now()
+	result := Aggregation{Source: rawSource}
+	var rows *sql.Rows
+	if tier := pickTier(d.history.Rollups, r, now); tier >= 0 {
+		t := d.history.Rollups[tier]
+		result.Source = t.Name
+		rows, err = d.DB.QueryContext(ctx, aggregateRollupQuery, mType, name, labels, r.From, r.To,
+			r.Step.Seconds(), int(t.Resolution.Seconds()))
+	} else {
+		rows, err = d.DB.QueryContext(ctx, aggregateHistoryQuery, mType, name, labels, r.From, r.To,
+			r.Step.Seconds(), pq.Array(r.Quantiles), d.history.since(r.From, now))
+	}
 	if err != nil {
-		return err
+		return Aggregation{}, err
 	}
-	for k, v := range d.st.GetCounterData() {
-		_, err = tx.Exec("INSERT INTO counter_metrics (name, value) VALUES ($1, $2); ", k, v)
-		if err != nil {
-			return err
+	defer rows.Close()
+
+	result.Buckets = make([]models.Bucket, 0)
+	for rows.Next() {
+		var idx int64
+		var b models.Bucket
+		dest := []any{&idx, &b.Count, &b.Sum, &b.Min, &b.Max, &b.First, &b.Last}
+		if result.Source == rawSource {
+			dest = append(dest, (*pq.Float64Array)(&b.Quantiles))
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return Aggregation{}, err
+		}
+		b.Start = r.From.Add(time.Duration(idx) * r.Step)
+		if len(r.Quantiles) == 0 {
+			b.Quantiles = nil
 		}
+		result.Buckets = append(result.Buckets, b)
 	}
+	return result, rows.Err()
+}
 
-	for k, v := range d.st.GetGaugeData() {
-		_, err = tx.Exec("INSERT INTO gauge_metrics (name, value) VALUES ($1, $2); ", k, v)
-		if err != nil {
-			return err
+// RollupHistory пересчитывает из истории окна предагрегации, которые могли измениться
+// с прошлого запуска, и удаляет окна старше срока хранения уровня.
+func (d *DBStore) RollupHistory(ctx context.Context) error {
+	if !d.history.enabled() {
+		return nil
+	}
+	now := time.Now()
+	for _, t := range d.history.Rollups {
+		res := int(t.Resolution.Seconds())
+		since := now.Add(-2 * historyPruneInterval).Truncate(t.Resolution)
+		if _, err := d.DB.ExecContext(ctx, rollupQuery, res, since); err != nil {
+			return fmt.Errorf("rollup %s: %w", t.Name, err)
+		}
+		if _, err := d.DB.ExecContext(ctx, pruneRollupsQuery, res, now.Add(-t.span())); err != nil {
+			return fmt.Errorf("prune rollup %s: %w", t.Name, err)
 		}
 	}
+	return nil
+}
 
-	return tx.Commit()
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// PruneHistory удаляет из истории значения сверх Size у каждой серии и старше Retention.
+func (d *DBStore) PruneHistory(ctx context.Context) error {
+	if !d.history.enabled() {
+		return nil
+	}
+	var cutoff time.Time
+	if d.history.Retention > 0 {
+		cutoff = time.Now().Add(-d.history.Retention)
+	}
+	_, err := d.DB.ExecContext(ctx, pruneHistoryQuery, d.history.Size, cutoff)
+	return err
+}
+
+// IntervalPrune раз в historyPruneInterval обновляет предагрегацию и затем вызывает
+// PruneHistory, пока не отменён ctx.
+func (d *DBStore) IntervalPrune(ctx context.Context) {
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.RollupHistory(ctx); err != nil && ctx.Err() == nil {
+				d.log.Error("rollup metric history", zap.Error(err))
+			}
+			if err := d.PruneHistory(ctx); err != nil && ctx.Err() == nil {
+				d.log.Error("prune metric history", zap.Error(err))
+			}
+		}
+	}
+}
+
+func parseLabels(data string) (map[string]string, error) {
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(data), &labels); err != nil {
+		return nil, fmt.Errorf("metric labels: %w", err)
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+func (d *DBStore) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+func (d *DBStore) Close() error {
+	return d.DB.Close()
 }
@@ -1,65 +1,394 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/lionslon/go-yapmetrics/internal/models"
 	"go.uber.org/zap"
 	"os"
-	"path"
+	"sync"
 	"time"
 )
 
+// journalCompactEntries после скольких записей журнала FileStore в синхронном режиме
+// сжимает журнал в снимок.
+const journalCompactEntries = 1000
+
+// fileSnapshot содержимое файла снимка. Seq номер последней записи журнала,
+// вошедшей в снимок; у файлов старого формата он равен нулю.
+type fileSnapshot struct {
+	Seq uint64 `json:"seq,omitempty"`
+	memSnapshot
+	Updated *snapshotTimes `json:"updated,omitempty"`
+}
+
+// snapshotTimes время последнего обновления метрик в снимке.
+type snapshotTimes struct {
+	Gauge   map[string]time.Time `json:"gauge"`
+	Counter map[string]time.Time `json:"counter"`
+}
+
 type fileProvider struct {
+	mu            sync.Mutex
 	filePath      string
 	storeInterval int
 	st            *MemStorage
+
+	// jmu упорядочивает записи журнала и снятие снимка, чтобы каждое обновление
+	// попадало либо в снимок, либо в хвост журнала, но не в оба сразу.
+	jmu     sync.Mutex
+	seq     uint64
+	journal *journal
+
+	log         *zap.Logger
+	observeDump func(time.Duration, error)
 }
 
 func (f *fileProvider) Check() error {
-	return errors.New("not provided for this storage type")
+	return ErrNotSupported
 }
 
 func NewFileProvider(filePath string, storeInterval int, m *MemStorage) StorageWorker {
+	return newFileProvider(filePath, storeInterval, m)
+}
+
+func newFileProvider(filePath string, storeInterval int, m *MemStorage) *fileProvider {
 	return &fileProvider{
 		filePath:      filePath,
 		storeInterval: storeInterval,
 		st:            m,
+		log:           zap.NewNop(),
 	}
 }
 
+// SetLogger задаёт логгер для сообщений о снимках и журнале. Вызывается до Restore.
+func (f *fileProvider) SetLogger(log *zap.Logger) {
+	f.log = log
+}
+
+// SetDumpObserver задаёт функцию, которая получает длительность и результат каждого Dump.
+// Вызывается до первого Dump.
+func (f *fileProvider) SetDumpObserver(observe func(time.Duration, error)) {
+	f.observeDump = observe
+}
+
+func (f *fileProvider) backupPath() string {
+	return f.filePath + ".bak"
+}
+
+func (f *fileProvider) journalPath() string {
+	return f.filePath + ".journal"
+}
+
+// Dump атомарно записывает снимок хранилища. Предыдущий снимок сохраняется рядом с
+// суффиксом .bak, а записи журнала, вошедшие в новый снимок, удаляются из журнала.
 func (f *fileProvider) Dump() error {
-	dir, _ := path.Split(f.filePath)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err := os.MkdirAll(dir, 0666)
-		if err != nil {
-			zap.S().Error(err)
-		}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.jmu.Lock()
+	snap := fileSnapshot{Seq: f.seq, memSnapshot: f.st.snapshot()}
+	f.jmu.Unlock()
+	if err := f.writeSnapshot(snap); err != nil {
+		return err
+	}
+	return f.compactJournal(snap.Seq)
+}
+
+// writeThrough сохраняет снимок, в котором уже применено обновление metrics, и только
+// после успешной записи применяет обновление к памяти через apply. Если запись не удалась,
+// память не меняется, и повтор запроса не применит приращение counter дважды.
+// Обновления выполняются по одному, чтобы снимок не потерял параллельное обновление.
+// Каждое обновление переписывает весь снимок с fsync, поэтому его стоимость растёт
+// с числом серий, а писатели ждут друг друга; сервер с -i 0 вместо этого пишет журнал.
+func (f *fileProvider) writeThrough(metrics []models.Metrics, apply func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.jmu.Lock()
+	snap := fileSnapshot{Seq: f.seq, memSnapshot: f.st.snapshot()}
+	f.jmu.Unlock()
+	snap.apply(metrics, time.Now())
+	if err := f.writeSnapshot(snap); err != nil {
+		return fmt.Errorf("persist metrics: %w", err)
 	}
+	return apply()
+}
 
-	data, err := json.MarshalIndent(f.st, "", "   ")
+// writeSnapshot атомарно записывает snap, сохраняя предыдущий файл как .bak.
+func (f *fileProvider) writeSnapshot(snap fileSnapshot) (err error) {
+	start := time.Now()
+	if f.observeDump != nil {
+		defer func() { f.observeDump(time.Since(start), err) }()
+	}
+	snap.Updated = &snapshotTimes{Gauge: snap.GaugeUpdated, Counter: snap.CounterUpdated}
+
+	data, err := json.MarshalIndent(snap, "", "   ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(f.filePath, data, 0666)
+	os.Remove(f.backupPath())
+	if err := os.Link(f.filePath, f.backupPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		f.log.Warn("cannot keep previous snapshot", zap.Error(err))
+	}
+	return writeFileAtomic(f.filePath, data)
 }
 
-func (f *fileProvider) IntervalDump() {
+// compactJournal оставляет в журнале только записи новее seq.
+func (f *fileProvider) compactJournal(seq uint64) error {
+	f.jmu.Lock()
+	defer f.jmu.Unlock()
+	if f.journal == nil {
+		return nil
+	}
+	var tail []journalEntry
+	if f.seq != seq {
+		var err error
+		tail, err = readJournal(f.journal.path, seq, f.log)
+		if err != nil {
+			return fmt.Errorf("compact journal: %w", err)
+		}
+	}
+	if err := f.journal.rewrite(tail); err != nil {
+		return fmt.Errorf("compact journal: %w", err)
+	}
+	return nil
+}
+
+// IntervalDump сохраняет метрики раз в storeInterval секунд, пока не отменён ctx.
+func (f *fileProvider) IntervalDump(ctx context.Context) {
 	pollTicker := time.NewTicker(time.Duration(f.storeInterval) * time.Second)
 	defer pollTicker.Stop()
-	for range pollTicker.C {
-		err := f.Dump()
-		if err != nil {
-			zap.S().Error(err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pollTicker.C:
+			err := f.Dump()
+			if err != nil {
+				f.log.Error("dump metrics", zap.Error(err))
+			}
 		}
 	}
 }
 
+// Restore загружает последний читаемый снимок (основной файл, затем .bak)
+// и применяет поверх него записи журнала, которые в снимок не вошли.
 func (f *fileProvider) Restore() error {
-	file, err := os.ReadFile(f.filePath)
+	snap, snapErr := f.loadSnapshot()
+	if snapErr == nil {
+		f.st.load(snap.memSnapshot)
+	}
+
+	entries, err := readJournal(f.journalPath(), snap.Seq, f.log)
 	if err != nil {
+		return errors.Join(snapErr, fmt.Errorf("read journal: %w", err))
+	}
+	seq := snap.Seq
+	for _, e := range entries {
+		if err := f.st.StoreBatch(context.Background(), e.Metrics); err != nil {
+			f.log.Warn("journal record skipped", zap.Uint64("seq", e.Seq), zap.Error(err))
+		}
+		seq = e.Seq
+	}
+	f.jmu.Lock()
+	f.seq = seq
+	f.jmu.Unlock()
+
+	if len(entries) > 0 {
+		f.log.Info("replayed journal records", zap.Int("records", len(entries)))
+		if errors.Is(snapErr, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return snapErr
+}
+
+func (f *fileProvider) loadSnapshot() (fileSnapshot, error) {
+	var firstErr error
+	for _, p := range []string{f.filePath, f.backupPath()} {
+		data, err := os.ReadFile(p)
+		if err == nil {
+			var snap fileSnapshot
+			if err = json.Unmarshal(data, &snap); err == nil {
+				if snap.Updated != nil {
+					snap.GaugeUpdated = snap.Updated.Gauge
+					snap.CounterUpdated = snap.Updated.Counter
+				}
+				return snap, nil
+			}
+			err = fmt.Errorf("snapshot %s: %w", p, err)
+			f.log.Warn("cannot load snapshot", zap.Error(err))
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return fileSnapshot{}, firstErr
+}
+
+// record применяет обновление к памяти. При включённом журнале обновление
+// сначала дописывается в журнал и применяется только после успешной записи.
+func (f *fileProvider) record(metrics []models.Metrics, apply func() error) error {
+	f.jmu.Lock()
+	if f.journal == nil {
+		f.jmu.Unlock()
+		return apply()
+	}
+	defer f.jmu.Unlock()
+	if err := f.journal.append(journalEntry{Seq: f.seq + 1, Metrics: metrics}); err != nil {
+		return fmt.Errorf("journal metrics: %w", err)
+	}
+	f.seq++
+	return apply()
+}
+
+// FileStore хранит метрики в памяти и сбрасывает их в файл через fileProvider.
+// При storeInterval == 0 без журнала каждое обновление сначала записывается в файл
+// и только потом применяется к памяти, ошибка записи возвращается вызывающему.
+// С журналом каждое обновление сразу дописывается в журнал, а снимок пишется
+// по расписанию.
+type FileStore struct {
+	*MemStorage
+	*fileProvider
+	synchronous bool
+}
+
+func NewFileStore(filePath string, storeInterval int) *FileStore {
+	m := NewMem()
+	return &FileStore{
+		MemStorage:   m,
+		fileProvider: newFileProvider(filePath, storeInterval, m),
+		synchronous:  storeInterval == 0,
+	}
+}
+
+// EnableJournal сохраняет снимок текущего состояния и начинает пустой журнал.
+// Вызывается после Restore и до начала обработки запросов.
+func (f *FileStore) EnableJournal() error {
+	if err := f.Dump(); err != nil {
+		return err
+	}
+	j, err := openJournal(f.journalPath())
+	if err != nil {
+		return err
+	}
+	f.jmu.Lock()
+	f.journal = j
+	f.jmu.Unlock()
+	return nil
+}
+
+func (f *FileStore) Close() error {
+	f.jmu.Lock()
+	defer f.jmu.Unlock()
+	if f.journal == nil {
+		return nil
+	}
+	err := f.journal.Close()
+	f.journal = nil
+	return err
+}
+
+func (f *FileStore) UpdateCounter(ctx context.Context, name string, delta int64) error {
+	m := seriesMetric(name, "counter")
+	m.Delta = &delta
+	return f.update([]models.Metrics{m}, func() error {
+		return f.MemStorage.UpdateCounter(ctx, name, delta)
+	})
+}
+
+func (f *FileStore) UpdateGauge(ctx context.Context, name string, value float64) error {
+	m := seriesMetric(name, "gauge")
+	m.Value = &value
+	return f.update([]models.Metrics{m}, func() error {
+		return f.MemStorage.UpdateGauge(ctx, name, value)
+	})
+}
+
+func (f *FileStore) StoreBatch(ctx context.Context, metrics []models.Metrics) error {
+	// Проверка до записи в журнал, чтобы в журнал не попадали отклонённые пакеты.
+	if err := ValidateBatch(metrics); err != nil {
+		return err
+	}
+	return f.update(metrics, func() error {
+		return f.MemStorage.StoreBatch(ctx, metrics)
+	})
+}
+
+// update сохраняет обновление metrics и применяет его к памяти через apply.
+// Без журнала в синхронном режиме обновление попадает в файл до применения к памяти.
+// С журналом обновление уже сохранено в журнале, поэтому ошибка сжатия журнала
+// только пишется в лог: иначе повтор запроса применил бы обновление второй раз.
+func (f *FileStore) update(metrics []models.Metrics, apply func() error) error {
+	f.jmu.Lock()
+	journaled := f.journal != nil
+	entries := 0
+	if journaled {
+		entries = f.journal.entries
+	}
+	f.jmu.Unlock()
+
+	if !journaled {
+		if f.synchronous {
+			return f.writeThrough(metrics, apply)
+		}
+		return apply()
+	}
+	if err := f.record(metrics, apply); err != nil {
 		return err
 	}
+	if f.synchronous && entries+1 >= journalCompactEntries {
+		if err := f.Dump(); err != nil {
+			f.log.Error("compact journal", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// PurgeStale удаляет устаревшие серии из памяти и сразу сохраняет снимок.
+func (f *FileStore) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	n, err := f.MemStorage.PurgeStale(ctx, before)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, f.persistRemoval()
+}
 
-	return json.Unmarshal(file, f.st)
+// Delete удаляет серию из памяти и сразу сохраняет снимок.
+func (f *FileStore) Delete(ctx context.Context, mType, key string) error {
+	if err := f.MemStorage.Delete(ctx, mType, key); err != nil {
+		return err
+	}
+	return f.persistRemoval()
+}
+
+// DeletePrefix удаляет серии по префиксу имени и сразу сохраняет снимок.
+func (f *FileStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	n, err := f.MemStorage.DeletePrefix(ctx, prefix)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, f.persistRemoval()
+}
+
+// ResetCounter обнуляет счётчик и сразу сохраняет снимок.
+func (f *FileStore) ResetCounter(ctx context.Context, key string) error {
+	if err := f.MemStorage.ResetCounter(ctx, key); err != nil {
+		return err
+	}
+	return f.persistRemoval()
+}
+
+// persistRemoval сохраняет снимок после удаления или сброса независимо от storeInterval.
+// Журнал хранит только приращения, поэтому без нового снимка удалённые серии и сброшенные
+// счётчики вернулись бы при перезапуске из старого снимка и журнала.
+func (f *FileStore) persistRemoval() error {
+	if err := f.Dump(); err != nil {
+		return fmt.Errorf("persist metrics: %w", err)
+	}
+	return nil
 }
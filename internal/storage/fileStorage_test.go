@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFileStoreSynchronousMode(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 0)
+
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 3))
+	restored := NewFileStore(path, 0)
+	require.NoError(t, restored.Restore())
+	assert.Equal(t, int64(3), mustCounter(t, restored.MemStorage, "PollCount"))
+
+	value := 1.25
+	require.NoError(t, f.StoreBatch(ctx, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+	restored = NewFileStore(path, 0)
+	require.NoError(t, restored.Restore())
+	assert.Equal(t, value, mustGauge(t, restored.MemStorage, "Alloc"))
+}
+
+func TestFileStoreFailedSynchronousWriteIsNotApplied(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	f := NewFileStore(filepath.Join(dir, "metrics.json"), 0)
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 5))
+
+	// Файл на месте каталога: снимок записать нельзя.
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.WriteFile(dir, nil, 0644))
+	assert.Error(t, f.UpdateCounter(ctx, "PollCount", 5))
+	assert.Error(t, f.UpdateCounter(ctx, "PollCount", 5), "a retry must fail the same way")
+
+	require.NoError(t, os.Remove(dir))
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 5))
+	assert.Equal(t, int64(10), mustCounter(t, f.MemStorage, "PollCount"), "failed updates must not be applied in memory")
+}
+
+func TestFileStoreIntervalModeDoesNotWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+
+	require.NoError(t, f.UpdateGauge(context.Background(), "Alloc", 1))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStoreSynchronousModeReportsErrors(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	f := NewFileStore(filepath.Join(blocker, "metrics.json"), 0)
+
+	assert.Error(t, f.UpdateGauge(context.Background(), "Alloc", 1))
+}
+
+func TestFileStoreDumpIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.UpdateCounter(context.Background(), "PollCount", 1))
+	require.NoError(t, f.Dump())
+	require.NoError(t, f.UpdateCounter(context.Background(), "PollCount", 1))
+	require.NoError(t, f.Dump())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.ElementsMatch(t, []string{"metrics.json", "metrics.json.bak"}, names, "temporary files must not be left behind")
+}
+
+func TestFileStoreRestoreFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.UpdateCounter(context.Background(), "PollCount", 2))
+	require.NoError(t, f.Dump())
+	require.NoError(t, f.Dump())
+	require.NoError(t, os.WriteFile(path, []byte(`{"gauge":{"Al`), 0644))
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	assert.Equal(t, int64(2), mustCounter(t, restored.MemStorage, "PollCount"))
+}
+
+func TestFileStoreRestoresLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"gauge":{"Alloc":1.5},"counter":{"PollCount":4}}`), 0644))
+
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.Restore())
+	assert.Equal(t, 1.5, mustGauge(t, f.MemStorage, "Alloc"))
+	assert.Equal(t, int64(4), mustCounter(t, f.MemStorage, "PollCount"))
+}
+
+func TestFileStoreLegacySnapshotIsNotStale(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"gauge":{"Alloc":1.5},"counter":{"PollCount":4}}`), 0644))
+
+	f := NewFileStore(path, 300)
+	f.SetTTL(time.Hour)
+	before := time.Now()
+	require.NoError(t, f.Restore())
+	list, err := f.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	for _, m := range list {
+		assert.False(t, m.Stale, m.ID)
+		assert.False(t, m.UpdatedAt.Before(before), "%s must be considered updated at load time", m.ID)
+	}
+
+	n, err := f.PurgeStale(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestFileStoreJournalReplay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, f.Dump())
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 2))
+	value := 3.5
+	require.NoError(t, f.StoreBatch(ctx, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}))
+
+	// Сбой без финального Dump: последняя запись журнала недописана.
+	journal, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = journal.WriteString(`{"seq":4,"metrics":[{"id":"PollCount","ty`)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	assert.Equal(t, int64(3), mustCounter(t, restored.MemStorage, "PollCount"), "records already in the snapshot must not be replayed twice")
+	assert.Equal(t, value, mustGauge(t, restored.MemStorage, "Alloc"))
+
+	require.NoError(t, restored.EnableJournal())
+	require.NoError(t, restored.UpdateCounter(ctx, "PollCount", 1))
+	again := NewFileStore(path, 300)
+	require.NoError(t, again.Restore())
+	assert.Equal(t, int64(4), mustCounter(t, again.MemStorage, "PollCount"))
+}
+
+func TestFileStoreDumpCompactsJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+	require.NoError(t, f.UpdateGauge(context.Background(), "Alloc", 1))
+
+	info, err := os.Stat(path + ".journal")
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	require.NoError(t, f.Dump())
+	info, err = os.Stat(path + ".journal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	require.NoError(t, f.Close())
+}
+
+func TestFileStoreJournalSkipsInvalidBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+
+	err := f.StoreBatch(context.Background(), []models.Metrics{{ID: "Alloc", MType: "gauge"}})
+	assert.Error(t, err)
+	entries, err := readJournal(path+".journal", 0, zap.NewNop())
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFileStoreKeepsUpdateTimes(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, f.Dump())
+	before, err := f.List(ctx)
+	require.NoError(t, err)
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	after, err := restored.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, after, 1)
+	assert.False(t, after[0].UpdatedAt.IsZero())
+	assert.True(t, before[0].UpdatedAt.Equal(after[0].UpdatedAt))
+}
+
+func TestFileStoreKeepsLabels(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+	key := models.SeriesKey("PollCount", map[string]string{"host": "web-1", "instance": `a"b`})
+	require.NoError(t, f.UpdateCounter(ctx, key, 2))
+	require.NoError(t, f.Dump())
+	require.NoError(t, f.UpdateCounter(ctx, key, 3))
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	assert.Equal(t, int64(5), mustCounter(t, restored.MemStorage, key))
+}
+
+func TestFileStorePurgeStaleSurvivesRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+	require.NoError(t, f.UpdateGauge(ctx, "Alloc", 1))
+	mid := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 2))
+
+	n, err := f.PurgeStale(ctx, mid)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	_, err = restored.GetGaugeValue(ctx, "Alloc")
+	assert.ErrorIs(t, err, ErrNotFound, "purged series must not come back from the journal")
+	assert.Equal(t, int64(2), mustCounter(t, restored.MemStorage, "PollCount"))
+}
+
+func TestFileStoreDeleteSurvivesRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	f := NewFileStore(path, 300)
+	require.NoError(t, f.EnableJournal())
+	require.NoError(t, f.UpdateGauge(ctx, "Typo", 1))
+	require.NoError(t, f.UpdateGauge(ctx, "TypoToo", 1))
+	require.NoError(t, f.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 5))
+
+	require.NoError(t, f.Delete(ctx, "gauge", "Alloc"))
+	n, err := f.DeletePrefix(ctx, "Typo")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, f.ResetCounter(ctx, "PollCount"))
+	require.NoError(t, f.UpdateCounter(ctx, "PollCount", 2))
+
+	restored := NewFileStore(path, 300)
+	require.NoError(t, restored.Restore())
+	metrics, err := restored.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "PollCount", metrics[0].ID)
+	assert.Equal(t, int64(2), *metrics[0].Delta)
+}
+
+func TestFileStoreObservesDumps(t *testing.T) {
+	dir := t.TempDir()
+	f := NewFileStore(filepath.Join(dir, "metrics.json"), 300)
+	var dumps, failed int
+	f.SetDumpObserver(func(d time.Duration, err error) {
+		dumps++
+		if err != nil {
+			failed++
+		}
+	})
+	require.NoError(t, f.Dump())
+
+	blocker := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	f.filePath = filepath.Join(blocker, "metrics.json")
+	assert.Error(t, f.Dump())
+	assert.Equal(t, 2, dumps)
+	assert.Equal(t, 1, failed)
+}
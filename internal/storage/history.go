@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+)
+
+// DefaultHistory ограничения истории, с которыми создаются хранилища. История
+// выключена: каждая серия с ней занимает в памяти и в базе в сотни раз больше,
+// поэтому включается явно через SetHistory.
+var DefaultHistory = HistoryConfig{Retention: 24 * time.Hour, Rollups: DefaultRollups}
+
+// DefaultRollups уровни предагрегации: минутные окна за сутки и часовые за месяц.
+var DefaultRollups = []RollupTier{
+	{Name: "1m", Resolution: time.Minute, Size: 1440},
+	{Name: "1h", Resolution: time.Hour, Size: 720},
+}
+
+// HistoryConfig ограничивает историю значений каждой серии.
+type HistoryConfig struct {
+	Size      int           // сколько последних значений хранить, 0 отключает историю
+	Retention time.Duration // максимальный возраст значения, 0 без ограничения
+	Rollups   []RollupTier  // уровни предагрегации, обновляются вместе с историей
+}
+
+func (c HistoryConfig) enabled() bool {
+	return c.Size > 0
+}
+
+// since сдвигает начало запрошенного интервала так, чтобы не выйти за Retention.
+func (c HistoryConfig) since(from, now time.Time) time.Time {
+	if c.Retention <= 0 {
+		return from
+	}
+	if oldest := now.Add(-c.Retention); from.Before(oldest) {
+		return oldest
+	}
+	return from
+}
+
+// history кольцевой буфер последних значений серии. Пока буфер не заполнен,
+// значения дописываются в конец, затем next указывает на самое старое.
+type history struct {
+	samples []models.Sample
+	next    int
+	rollups []rollup
+}
+
+func (h *history) add(s models.Sample, cfg HistoryConfig) {
+	if h.rollups == nil && len(cfg.Rollups) > 0 {
+		h.rollups = make([]rollup, len(cfg.Rollups))
+	}
+	for i, t := range cfg.Rollups {
+		h.rollups[i].add(s, t)
+	}
+	size := cfg.Size
+	if len(h.samples) < size {
+		h.samples = append(h.samples, s)
+		return
+	}
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+}
+
+// between возвращает значения из [from, to] в хронологическом порядке.
+// Нулевые from и to не ограничивают интервал.
+func (h *history) between(from, to time.Time) []models.Sample {
+	result := make([]models.Sample, 0)
+	if h == nil {
+		return result
+	}
+	for i := range h.samples {
+		s := h.samples[(h.next+i)%len(h.samples)]
+		if !from.IsZero() && s.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && s.Time.After(to) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func addSample(m map[string]*history, key string, s models.Sample, cfg HistoryConfig) {
+	if !cfg.enabled() {
+		return
+	}
+	h, ok := m[key]
+	if !ok {
+		h = &history{}
+		m[key] = h
+	}
+	h.add(s, cfg)
+}
+
+// aggregate считает окна запроса по уровню предагрегации, если он подходит, иначе по истории.
+func (h *history) aggregate(cfg HistoryConfig, r QueryRange, now time.Time) Aggregation {
+	b := newBucketer(r)
+	if tier := pickTier(cfg.Rollups, r, now); tier >= 0 && h != nil && tier < len(h.rollups) {
+		h.rollups[tier].each(func(rb models.Bucket) { b.add(rb.Start, rb) })
+		return Aggregation{Source: cfg.Rollups[tier].Name, Buckets: b.result()}
+	}
+	for _, s := range h.between(cfg.since(r.From, now), time.Time{}) {
+		b.addSample(s)
+	}
+	return Aggregation{Source: rawSource, Buckets: b.result()}
+}
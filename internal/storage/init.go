@@ -1,15 +1,112 @@
 package storage
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("metric not found")
+	ErrNotSupported = errors.New("not provided for this storage type")
+)
+
+// MetricsStore общий интерфейс хранилищ метрик, с которым работают хендлеры.
+// Параметр name — ключ серии (models.SeriesKey), для метрики без меток он равен имени.
+type MetricsStore interface {
+	UpdateCounter(ctx context.Context, name string, delta int64) error
+	UpdateGauge(ctx context.Context, name string, value float64) error
+	GetCounterValue(ctx context.Context, name string) (int64, error)
+	GetGaugeValue(ctx context.Context, name string) (float64, error)
+	StoreBatch(ctx context.Context, metrics []models.Metrics) error
+	List(ctx context.Context) ([]models.Metrics, error)
+	History(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error)
+	Aggregate(ctx context.Context, mType, name string, r QueryRange) (Aggregation, error)
+	// PurgeStale удаляет серии, которые не обновлялись с before, вместе с их историей,
+	// и возвращает, сколько серий удалено.
+	PurgeStale(ctx context.Context, before time.Time) (int, error)
+	// Delete удаляет серию вместе с её историей, ErrNotFound если серии нет.
+	Delete(ctx context.Context, mType, name string) error
+	// DeletePrefix удаляет серии обоих типов, имя которых (без меток) начинается с prefix.
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// ResetCounter обнуляет счётчик, ErrNotFound если его нет.
+	ResetCounter(ctx context.Context, name string) error
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ MetricsStore = (*MemStorage)(nil)
+	_ MetricsStore = (*FileStore)(nil)
+	_ MetricsStore = (*DBStore)(nil)
+)
+
 type StorageWorker interface {
 	Restore() error
 	Dump() error
-	IntervalDump()
+	IntervalDump(ctx context.Context)
 	Check() error
 }
 
+// HistoryPruner хранилище, которому нужна периодическая очистка истории.
+type HistoryPruner interface {
+	IntervalPrune(ctx context.Context)
+}
+
+var _ HistoryPruner = (*DBStore)(nil)
+
 type StorageProvider int
 
 const (
 	FileProvider StorageProvider = iota + 1
 	DBProvider
 )
+
+// BatchError возвращается StoreBatch, если хотя бы один элемент пакета некорректен.
+// В этом случае ни один элемент пакета не сохраняется.
+type BatchError struct {
+	Items []models.BatchItemError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch rejected: %d invalid metrics, first at index %d: %s",
+		len(e.Items), e.Items[0].Index, e.Items[0].Reason)
+}
+
+// ValidateBatch проверяет все элементы пакета и возвращает *BatchError со списком отклонённых.
+func ValidateBatch(metrics []models.Metrics) error {
+	var items []models.BatchItemError
+	for i, m := range metrics {
+		if err := m.Validate(); err != nil {
+			items = append(items, models.BatchItemError{Index: i, ID: m.ID, Reason: err.Error()})
+		}
+	}
+	if len(items) > 0 {
+		return &BatchError{Items: items}
+	}
+	return nil
+}
+
+func sortMetrics(metrics []models.Metrics) {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType == "gauge"
+		}
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].Key() < metrics[j].Key()
+	})
+}
+
+// seriesMetric метрика типа mType с именем и метками из ключа серии.
+// Ключ, который не удаётся разобрать, целиком становится именем.
+func seriesMetric(key, mType string) models.Metrics {
+	id, labels, err := models.ParseSeriesKey(key)
+	if err != nil {
+		return models.Metrics{ID: key, MType: mType}
+	}
+	return models.Metrics{ID: id, MType: mType, Labels: labels}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// journalEntry одна строка журнала: обновления, применённые одним вызовом хранилища.
+// Seq растёт монотонно, снимок хранит Seq последней вошедшей в него записи.
+type journalEntry struct {
+	Seq     uint64           `json:"seq"`
+	Metrics []models.Metrics `json:"metrics"`
+}
+
+// journal файл с записями в формате JSON lines, открытый на дозапись.
+type journal struct {
+	path    string
+	file    *os.File
+	entries int
+}
+
+// openJournal создаёт пустой журнал, существующий файл обрезается.
+func openJournal(path string) (*journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, file: file}, nil
+}
+
+// append дописывает запись и дожидается её сброса на диск.
+func (j *journal) append(e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
+
+// rewrite атомарно заменяет содержимое журнала переданными записями.
+func (j *journal) rewrite(entries []journalEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(j.path, buf.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.entries = len(entries)
+	return nil
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// readJournal читает записи с Seq больше after. Чтение останавливается на первой
+// недописанной или повреждённой строке: это хвост записи, прерванной сбоем.
+func readJournal(path string, after uint64, log *zap.Logger) ([]journalEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Warn("journal: dropping incomplete last record", zap.String("path", path))
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Warn("journal: dropping corrupted tail", zap.String("path", path), zap.Error(err))
+			return entries, nil
+		}
+		if e.Seq > after {
+			entries = append(entries, e)
+		}
+	}
+}
+
+// writeFileAtomic пишет данные во временный файл рядом с path, сбрасывает его на диск
+// и переименовывает в path, после чего сбрасывает каталог. При сбое на диске остаётся
+// либо старое, либо новое содержимое целиком.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
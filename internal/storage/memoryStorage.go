@@ -1,101 +1,501 @@
 package storage
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
 	"github.com/lionslon/go-yapmetrics/internal/models"
-	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+// shardsCount количество сегментов хранилища. Метрика попадает в сегмент
+// по хешу имени, поэтому обновления разных метрик почти не конкурируют за блокировку.
+const shardsCount = 32
+
 type gauge float64
 type counter int64
 
+type shard struct {
+	mu             sync.RWMutex
+	gaugeData      map[string]gauge
+	counterData    map[string]counter
+	gaugeUpdated   map[string]time.Time
+	counterUpdated map[string]time.Time
+	gaugeHistory   map[string]*history
+	counterHistory map[string]*history
+}
+
+// MemStorage хранит последнее значение каждой серии и, если история включена,
+// кольцевой буфер её последних значений. История не входит в снимок и не
+// переживает перезапуск.
 type MemStorage struct {
-	GaugeData   map[string]gauge   `json:"gauge"`
-	CounterData map[string]counter `json:"counter"`
+	shards  [shardsCount]*shard
+	history HistoryConfig
+	ttl     time.Duration
 }
 
-//type AllMetrics struct {
-//	Gauge   map[string]gauge   `json:"gauge"`
-//	Counter map[string]counter `json:"counter"`
-//}
+// memSnapshot формат сериализации хранилища, совпадает с прежним форматом файла.
+// Время обновления в этот формат не входит, его сохраняет fileSnapshot.
+type memSnapshot struct {
+	Gauge          map[string]gauge     `json:"gauge"`
+	Counter        map[string]counter   `json:"counter"`
+	GaugeUpdated   map[string]time.Time `json:"-"`
+	CounterUpdated map[string]time.Time `json:"-"`
+}
 
 func NewMem() *MemStorage {
-	storage := MemStorage{
-		GaugeData:   make(map[string]gauge),
-		CounterData: make(map[string]counter),
+	storage := MemStorage{history: DefaultHistory}
+	for i := range storage.shards {
+		storage.shards[i] = &shard{
+			gaugeData:      make(map[string]gauge),
+			counterData:    make(map[string]counter),
+			gaugeUpdated:   make(map[string]time.Time),
+			counterUpdated: make(map[string]time.Time),
+			gaugeHistory:   make(map[string]*history),
+			counterHistory: make(map[string]*history),
+		}
 	}
 
 	return &storage
 }
 
-func (s *MemStorage) UpdateCounter(n string, v int64) {
-	s.CounterData[n] += counter(v)
+// SetHistory меняет ограничения истории. Вызывается до начала обработки запросов;
+// уже накопленная история сбрасывается.
+func (s *MemStorage) SetHistory(cfg HistoryConfig) {
+	s.lockAll()
+	defer s.unlockAll()
+	s.history = cfg
+	for _, sh := range s.shards {
+		sh.gaugeHistory = make(map[string]*history)
+		sh.counterHistory = make(map[string]*history)
+	}
+}
+
+// SetTTL задаёт, через сколько после последнего обновления серия считается устаревшей.
+// 0 отключает отметку устаревших серий.
+func (s *MemStorage) SetTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
+
+// shardIndex считает FNV-1a хеш имени без аллокаций.
+func shardIndex(n string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(n); i++ {
+		h ^= uint32(n[i])
+		h *= 16777619
+	}
+	return int(h % shardsCount)
+}
+
+func (s *MemStorage) shard(n string) *shard {
+	return s.shards[shardIndex(n)]
+}
+
+// lockAll блокирует все сегменты по порядку индексов, чтобы не было взаимных блокировок
+// с StoreBatch, который берёт сегменты в том же порядке.
+func (s *MemStorage) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *MemStorage) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+func (s *MemStorage) rLockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+}
+
+func (s *MemStorage) rUnlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RUnlock()
+	}
+}
+
+func (s *MemStorage) UpdateCounter(_ context.Context, n string, v int64) error {
+	sh := s.shard(n)
+	now := time.Now()
+	sh.mu.Lock()
+	sh.counterData[n] += counter(v)
+	sh.counterUpdated[n] = now
+	addSample(sh.counterHistory, n, models.Sample{Time: now, Value: float64(sh.counterData[n])}, s.history)
+	sh.mu.Unlock()
+	return nil
+}
+
+func (s *MemStorage) UpdateGauge(_ context.Context, n string, v float64) error {
+	sh := s.shard(n)
+	now := time.Now()
+	sh.mu.Lock()
+	sh.gaugeData[n] = gauge(v)
+	sh.gaugeUpdated[n] = now
+	addSample(sh.gaugeHistory, n, models.Sample{Time: now, Value: v}, s.history)
+	sh.mu.Unlock()
+	return nil
+}
+
+func (s *MemStorage) GetCounterValue(_ context.Context, id string) (int64, error) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v, ok := sh.counterData[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int64(v), nil
+}
+
+func (s *MemStorage) GetGaugeValue(_ context.Context, id string) (float64, error) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	v, ok := sh.gaugeData[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return float64(v), nil
+}
+
+// List возвращает все метрики: сначала gauge, затем counter, каждая группа отсортирована по имени.
+func (s *MemStorage) List(_ context.Context) ([]models.Metrics, error) {
+	snap := s.snapshot()
+	result := make([]models.Metrics, 0, len(snap.Gauge)+len(snap.Counter))
+	for n, v := range snap.Gauge {
+		m := seriesMetric(n, "gauge")
+		value := float64(v)
+		m.Value = &value
+		m.UpdatedAt = snap.GaugeUpdated[n]
+		result = append(result, m)
+	}
+	for n, v := range snap.Counter {
+		m := seriesMetric(n, "counter")
+		delta := int64(v)
+		m.Delta = &delta
+		m.UpdatedAt = snap.CounterUpdated[n]
+		result = append(result, m)
+	}
+	sortMetrics(result)
+	markStale(result, s.ttl, time.Now())
+	return result, nil
+}
+
+// PurgeStale удаляет серии, которые не обновлялись с before. Серии без времени
+// обновления не трогаются.
+func (s *MemStorage) PurgeStale(_ context.Context, before time.Time) (int, error) {
+	s.lockAll()
+	defer s.unlockAll()
+	purged := 0
+	for _, sh := range s.shards {
+		for n, t := range sh.gaugeUpdated {
+			if t.Before(before) {
+				delete(sh.gaugeData, n)
+				delete(sh.gaugeUpdated, n)
+				delete(sh.gaugeHistory, n)
+				purged++
+			}
+		}
+		for n, t := range sh.counterUpdated {
+			if t.Before(before) {
+				delete(sh.counterData, n)
+				delete(sh.counterUpdated, n)
+				delete(sh.counterHistory, n)
+				purged++
+			}
+		}
+	}
+	return purged, nil
+}
+
+// Delete удаляет серию вместе с её историей.
+func (s *MemStorage) Delete(_ context.Context, mType, key string) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	switch mType {
+	case "counter":
+		if _, ok := sh.counterData[key]; ok {
+			delete(sh.counterData, key)
+			delete(sh.counterUpdated, key)
+			delete(sh.counterHistory, key)
+			return nil
+		}
+	case "gauge":
+		if _, ok := sh.gaugeData[key]; ok {
+			delete(sh.gaugeData, key)
+			delete(sh.gaugeUpdated, key)
+			delete(sh.gaugeHistory, key)
+			return nil
+		}
+	}
+	return ErrNotFound
 }
 
-func (s *MemStorage) UpdateGauge(n string, v float64) {
-	s.GaugeData[n] = gauge(v)
+// DeletePrefix удаляет серии обоих типов, имя которых начинается с prefix.
+func (s *MemStorage) DeletePrefix(_ context.Context, prefix string) (int, error) {
+	s.lockAll()
+	defer s.unlockAll()
+	deleted := 0
+	for _, sh := range s.shards {
+		for n := range sh.gaugeData {
+			if hasNamePrefix(n, prefix) {
+				delete(sh.gaugeData, n)
+				delete(sh.gaugeUpdated, n)
+				delete(sh.gaugeHistory, n)
+				deleted++
+			}
+		}
+		for n := range sh.counterData {
+			if hasNamePrefix(n, prefix) {
+				delete(sh.counterData, n)
+				delete(sh.counterUpdated, n)
+				delete(sh.counterHistory, n)
+				deleted++
+			}
+		}
+	}
+	return deleted, nil
 }
 
-func (s *MemStorage) GetValue(t string, n string) (string, int) {
-	var v string
-	statusCode := http.StatusOK
-	if val, ok := s.GaugeData[n]; ok && t == "gauge" {
-		v = fmt.Sprint(val)
-	} else if val, ok := s.CounterData[n]; ok && t == "counter" {
-		v = fmt.Sprint(val)
-	} else {
-		statusCode = http.StatusNotFound
+// hasNamePrefix проверяет, что имя серии с ключом key начинается с prefix.
+// Имя не может содержать '{', поэтому оно заканчивается перед первой '{' ключа.
+func hasNamePrefix(key, prefix string) bool {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		key = key[:i]
 	}
-	return v, statusCode
+	return strings.HasPrefix(key, prefix)
 }
 
-func (s *MemStorage) AllMetrics() string {
-	var result string
-	result += "Gauge metrics:\n"
-	for n, v := range s.GaugeData {
-		result += fmt.Sprintf("- %s = %f\n", n, v)
+// ResetCounter обнуляет счётчик. Если история включена, в неё попадает нулевое значение.
+func (s *MemStorage) ResetCounter(_ context.Context, key string) error {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.counterData[key]; !ok {
+		return ErrNotFound
 	}
+	now := time.Now()
+	sh.counterData[key] = 0
+	sh.counterUpdated[key] = now
+	addSample(sh.counterHistory, key, models.Sample{Time: now, Value: 0}, s.history)
+	return nil
+}
 
-	result += "Counter metrics:\n"
-	for n, v := range s.CounterData {
-		result += fmt.Sprintf("- %s = %d\n", n, v)
+// History возвращает значения серии из [from, to], но не старше Retention.
+func (s *MemStorage) History(_ context.Context, mType, key string, from, to time.Time) ([]models.Sample, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	h, err := s.seriesHistory(sh, mType, key)
+	if err != nil {
+		return nil, err
 	}
+	return h.between(s.history.since(from, time.Now()), to), nil
+}
 
-	return result
+// seriesHistory история серии из сегмента sh, вызывается под его блокировкой.
+// У существующей серии без истории возвращается nil.
+func (s *MemStorage) seriesHistory(sh *shard, mType, key string) (*history, error) {
+	var h *history
+	var ok bool
+	switch mType {
+	case "counter":
+		_, ok = sh.counterData[key]
+		h = sh.counterHistory[key]
+	case "gauge":
+		_, ok = sh.gaugeData[key]
+		h = sh.gaugeHistory[key]
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !s.history.enabled() {
+		return nil, ErrNotSupported
+	}
+	return h, nil
 }
 
-func (s *MemStorage) GetCounterValue(id string) int64 {
-	return int64(s.CounterData[id])
+// Aggregate считает статистику серии по окнам r.
+func (s *MemStorage) Aggregate(_ context.Context, mType, key string, r QueryRange) (Aggregation, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	h, err := s.seriesHistory(sh, mType, key)
+	if err != nil {
+		return Aggregation{}, err
+	}
+	return h.aggregate(s.history, r, time.Now()), nil
 }
 
-func (s *MemStorage) GetGaugeValue(id string) float64 {
-	return float64(s.GaugeData[id])
+func (s *MemStorage) Ping(_ context.Context) error {
+	return ErrNotSupported
 }
 
+// GetCounterData возвращает копию счётчиков, которую можно читать без блокировок.
 func (s *MemStorage) GetCounterData() map[string]counter {
-	return s.CounterData
+	return s.snapshot().Counter
 }
 
+// GetGaugeData возвращает копию gauge-метрик, которую можно читать без блокировок.
 func (s *MemStorage) GetGaugeData() map[string]gauge {
-	return s.GaugeData
+	return s.snapshot().Gauge
 }
 
 func (s *MemStorage) UpdateGaugeData(gaugeData map[string]gauge) {
-	s.GaugeData = gaugeData
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		sh.gaugeData = make(map[string]gauge)
+		sh.gaugeUpdated = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for n, v := range gaugeData {
+		s.shard(n).gaugeData[n] = v
+		s.shard(n).gaugeUpdated[n] = now
+	}
 }
 
 func (s *MemStorage) UpdateCounterData(counterData map[string]counter) {
-	s.CounterData = counterData
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		sh.counterData = make(map[string]counter)
+		sh.counterUpdated = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for n, v := range counterData {
+		s.shard(n).counterData[n] = v
+		s.shard(n).counterUpdated[n] = now
+	}
 }
 
-func (s *MemStorage) StoreBatch(metrics []models.Metrics) {
+// StoreBatch применяет пакет под блокировкой всех затронутых сегментов,
+// поэтому читатели видят либо весь пакет, либо ничего из него.
+// Некорректный пакет отклоняется целиком с *BatchError.
+func (s *MemStorage) StoreBatch(_ context.Context, metrics []models.Metrics) error {
+	if err := ValidateBatch(metrics); err != nil {
+		return err
+	}
+
+	var touched [shardsCount]bool
+	for _, m := range metrics {
+		touched[shardIndex(m.Key())] = true
+	}
+	for i, ok := range touched {
+		if ok {
+			s.shards[i].mu.Lock()
+		}
+	}
+	defer func() {
+		for i, ok := range touched {
+			if ok {
+				s.shards[i].mu.Unlock()
+			}
+		}
+	}()
+
+	now := time.Now()
 	for _, m := range metrics {
+		key := m.Key()
+		sh := s.shard(key)
 		switch m.MType {
 		case "counter":
-			s.UpdateCounter(m.ID, *m.Delta)
+			sh.counterData[key] += counter(*m.Delta)
+			sh.counterUpdated[key] = now
+			addSample(sh.counterHistory, key, models.Sample{Time: now, Value: float64(sh.counterData[key])}, s.history)
 		case "gauge":
-			s.UpdateGauge(m.ID, *m.Value)
+			sh.gaugeData[key] = gauge(*m.Value)
+			sh.gaugeUpdated[key] = now
+			addSample(sh.gaugeHistory, key, models.Sample{Time: now, Value: *m.Value}, s.history)
 		}
+	}
+	return nil
+}
 
+// snapshot делает согласованную копию всех сегментов.
+func (s *MemStorage) snapshot() memSnapshot {
+	snap := memSnapshot{
+		Gauge:          make(map[string]gauge),
+		Counter:        make(map[string]counter),
+		GaugeUpdated:   make(map[string]time.Time),
+		CounterUpdated: make(map[string]time.Time),
+	}
+	s.rLockAll()
+	defer s.rUnlockAll()
+	for _, sh := range s.shards {
+		for n, v := range sh.gaugeData {
+			snap.Gauge[n] = v
+		}
+		for n, v := range sh.counterData {
+			snap.Counter[n] = v
+		}
+		for n, t := range sh.gaugeUpdated {
+			snap.GaugeUpdated[n] = t
+		}
+		for n, t := range sh.counterUpdated {
+			snap.CounterUpdated[n] = t
+		}
+	}
+	return snap
+}
+
+// apply применяет metrics к снимку так же, как StoreBatch к хранилищу.
+func (snap memSnapshot) apply(metrics []models.Metrics, now time.Time) {
+	for _, m := range metrics {
+		key := m.Key()
+		switch m.MType {
+		case "counter":
+			snap.Counter[key] += counter(*m.Delta)
+			snap.CounterUpdated[key] = now
+		case "gauge":
+			snap.Gauge[key] = gauge(*m.Value)
+			snap.GaugeUpdated[key] = now
+		}
+	}
+}
+
+func (s *MemStorage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.snapshot())
+}
+
+// UnmarshalJSON дописывает загруженные значения к текущим, как это делал json.Unmarshal для обычных map.
+func (s *MemStorage) UnmarshalJSON(data []byte) error {
+	var snap memSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	s.load(snap)
+	return nil
+}
+
+// load дописывает значения снимка. В снимках старого формата нет времени обновления,
+// такие серии считаются обновлёнными в момент загрузки: иначе они сразу оказались бы
+// устаревшими и не удалялись бы PurgeStale.
+func (s *MemStorage) load(snap memSnapshot) {
+	s.lockAll()
+	defer s.unlockAll()
+	now := time.Now()
+	for n, v := range snap.Gauge {
+		s.shard(n).gaugeData[n] = v
+		t, ok := snap.GaugeUpdated[n]
+		if !ok {
+			t = now
+		}
+		s.shard(n).gaugeUpdated[n] = t
+	}
+	for n, v := range snap.Counter {
+		s.shard(n).counterData[n] = v
+		t, ok := snap.CounterUpdated[n]
+		if !ok {
+			t = now
+		}
+		s.shard(n).counterUpdated[n] = t
 	}
 }
@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/lionslon/go-yapmetrics/internal/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUpdateCounter(t *testing.T) {
+	ctx := context.Background()
 	s := NewMem()
 	testCases := []struct {
 		name        string
@@ -22,13 +31,14 @@ func TestUpdateCounter(t *testing.T) {
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			s.UpdateCounter(test.metricsName, test.value)
-			assert.Equal(t, counter(test.want), s.CounterData[test.metricsName])
+			s.UpdateCounter(ctx, test.metricsName, test.value)
+			assert.Equal(t, test.want, mustCounter(t, s, test.metricsName))
 		})
 	}
 }
 
 func TestUpdateGauge(t *testing.T) {
+	ctx := context.Background()
 	s := NewMem()
 	testCases := []struct {
 		name        string
@@ -43,8 +53,348 @@ func TestUpdateGauge(t *testing.T) {
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			s.UpdateGauge(test.metricsName, test.value)
-			assert.Equal(t, gauge(test.want), s.GaugeData[test.metricsName])
+			s.UpdateGauge(ctx, test.metricsName, test.value)
+			assert.Equal(t, test.want, mustGauge(t, s, test.metricsName))
 		})
 	}
 }
+
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	f := NewFileProvider(filepath.Join(t.TempDir(), "metrics.json"), 1, s)
+	const workers = 16
+	const iterations = 500
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				delta := int64(1)
+				value := float64(i)
+				s.UpdateCounter(ctx, "counter", 1)
+				s.UpdateGauge(ctx, fmt.Sprintf("gauge%d", w), float64(i))
+				s.StoreBatch(ctx, []models.Metrics{
+					{ID: "batchCounter", MType: "counter", Delta: &delta},
+					{ID: fmt.Sprintf("batchGauge%d", i%8), MType: "gauge", Value: &value},
+				})
+				_, _ = s.GetCounterValue(ctx, "counter")
+			}
+		}(w)
+	}
+	for d := 0; d < 4; d++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.NoError(t, f.Dump())
+				_, _ = s.List(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(workers*iterations), mustCounter(t, s, "counter"))
+	assert.Equal(t, int64(workers*iterations), mustCounter(t, s, "batchCounter"))
+	assert.Equal(t, float64(iterations-1), mustGauge(t, s, "gauge0"))
+}
+
+func TestStoreBatchIsAtomicForReaders(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	one := int64(1)
+	batch := make([]models.Metrics, 0, 64)
+	for i := 0; i < 64; i++ {
+		batch = append(batch, models.Metrics{ID: fmt.Sprintf("c%d", i), MType: "counter", Delta: &one})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s.StoreBatch(ctx, batch)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		counters := s.GetCounterData()
+		first := counters["c0"]
+		for n, v := range counters {
+			require.Equal(t, first, v, "counter %s is out of sync with c0", n)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.UpdateCounter(ctx, "PollCount", 5)
+	s.UpdateGauge(ctx, "Alloc", 1.5)
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"gauge":{"Alloc":1.5},"counter":{"PollCount":5}}`, string(data))
+
+	restored := NewMem()
+	require.NoError(t, json.Unmarshal(data, restored))
+	assert.Equal(t, int64(5), mustCounter(t, restored, "PollCount"))
+	assert.Equal(t, 1.5, mustGauge(t, restored, "Alloc"))
+}
+
+func TestLabeledSeriesAreSeparate(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	a, b := 1.0, 2.0
+	require.NoError(t, s.StoreBatch(ctx, []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &a, Labels: map[string]string{"host": "a"}},
+		{ID: "Alloc", MType: "gauge", Value: &b, Labels: map[string]string{"host": "b"}},
+	}))
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 3))
+
+	assert.Equal(t, 1.0, mustGauge(t, s, models.SeriesKey("Alloc", map[string]string{"host": "a"})))
+	assert.Equal(t, 3.0, mustGauge(t, s, "Alloc"))
+
+	list, err := s.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Nil(t, list[0].Labels)
+	assert.Equal(t, map[string]string{"host": "a"}, list[1].Labels)
+	assert.Equal(t, map[string]string{"host": "b"}, list[2].Labels)
+	for _, m := range list {
+		assert.Equal(t, "Alloc", m.ID)
+	}
+}
+
+func TestHistoryKeepsRecentSamples(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetHistory(HistoryConfig{Size: 3})
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, s.UpdateGauge(ctx, "Alloc", float64(i)))
+		require.NoError(t, s.UpdateCounter(ctx, "PollCount", 2))
+	}
+
+	samples, err := s.History(ctx, "gauge", "Alloc", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{3, 4, 5}, sampleValues(samples))
+	assert.False(t, samples[0].Time.After(samples[2].Time))
+
+	samples, err = s.History(ctx, "counter", "PollCount", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{6, 8, 10}, sampleValues(samples), "counter history keeps running totals")
+
+	samples, err = s.History(ctx, "gauge", "Alloc", time.Now().Add(time.Hour), time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	_, err = s.History(ctx, "counter", "Alloc", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetHistory(HistoryConfig{Size: 10, Retention: time.Hour})
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 1))
+	sh := s.shard("Alloc")
+	sh.gaugeHistory["Alloc"].samples[0].Time = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 2))
+
+	samples, err := s.History(ctx, "gauge", "Alloc", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{2}, sampleValues(samples))
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetHistory(HistoryConfig{})
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 1))
+
+	_, err := s.History(ctx, "gauge", "Alloc", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func sampleValues(samples []models.Sample) []float64 {
+	values := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		values = append(values, s.Value)
+	}
+	return values
+}
+
+func mustCounter(t *testing.T, s *MemStorage, name string) int64 {
+	v, err := s.GetCounterValue(context.Background(), name)
+	require.NoError(t, err)
+	return v
+}
+
+func mustGauge(t *testing.T, s *MemStorage, name string) float64 {
+	v, err := s.GetGaugeValue(context.Background(), name)
+	require.NoError(t, err)
+	return v
+}
+
+func BenchmarkUpdateCounterParallel(b *testing.B) {
+	ctx := context.Background()
+	s := NewMem()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.UpdateCounter(ctx, fmt.Sprintf("counter%d", i%100), 1)
+			i++
+		}
+	})
+}
+
+func BenchmarkUpdateGaugeParallel(b *testing.B) {
+	ctx := context.Background()
+	s := NewMem()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.UpdateGauge(ctx, fmt.Sprintf("gauge%d", i%100), float64(i))
+			i++
+		}
+	})
+}
+
+func BenchmarkStoreBatchParallel(b *testing.B) {
+	ctx := context.Background()
+	s := NewMem()
+	delta := int64(1)
+	value := 1.5
+	batch := make([]models.Metrics, 0, 30)
+	for i := 0; i < 30; i++ {
+		batch = append(batch, models.Metrics{ID: fmt.Sprintf("gauge%d", i), MType: "gauge", Value: &value})
+	}
+	batch = append(batch, models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.StoreBatch(ctx, batch)
+		}
+	})
+}
+
+func BenchmarkDumpWithWriters(b *testing.B) {
+	ctx := context.Background()
+	s := NewMem()
+	for i := 0; i < 100; i++ {
+		s.UpdateGauge(ctx, fmt.Sprintf("gauge%d", i), float64(i))
+	}
+	f := NewFileProvider(filepath.Join(b.TempDir(), "metrics.json"), 1, s)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.UpdateCounter(ctx, "PollCount", 1)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f.Dump(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+func TestStoreBatchRejectsInvalidItems(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	one := int64(1)
+	value := 2.5
+	batch := []models.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &one},
+		{ID: "Alloc", MType: "gauge"},
+		{ID: "Alloc", MType: "histogram", Value: &value},
+		{ID: "", MType: "gauge", Value: &value},
+	}
+
+	err := s.StoreBatch(ctx, batch)
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	require.Len(t, batchErr.Items, 3)
+	assert.Equal(t, []int{1, 2, 3}, []int{batchErr.Items[0].Index, batchErr.Items[1].Index, batchErr.Items[2].Index})
+	assert.Equal(t, "gauge without value", batchErr.Items[0].Reason)
+
+	_, err = s.GetCounterValue(ctx, "PollCount")
+	assert.ErrorIs(t, err, ErrNotFound, "valid items must not be applied when the batch is rejected")
+}
+
+func TestStaleSeries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetTTL(time.Hour)
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, s.UpdateCounter(ctx, "PollCount", 1))
+	s.shard("Alloc").gaugeUpdated["Alloc"] = time.Now().Add(-2 * time.Hour)
+
+	metrics, err := s.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "Alloc", metrics[0].ID)
+	assert.True(t, metrics[0].Stale)
+	assert.False(t, metrics[1].Stale)
+
+	n, err := s.PurgeStale(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = s.GetGaugeValue(ctx, "Alloc")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.History(ctx, "gauge", "Alloc", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, int64(1), mustCounter(t, s, "PollCount"))
+}
+
+func TestDeleteSeries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMem()
+	s.SetHistory(HistoryConfig{Size: 10})
+	labeled := models.SeriesKey("TestCounter", map[string]string{"host": "a"})
+	require.NoError(t, s.UpdateCounter(ctx, labeled, 1))
+	require.NoError(t, s.UpdateCounter(ctx, "TestCounter", 1))
+	require.NoError(t, s.UpdateGauge(ctx, "TestCounter", 1))
+	require.NoError(t, s.UpdateGauge(ctx, "Test", 1))
+	require.NoError(t, s.UpdateGauge(ctx, "Alloc", 1))
+
+	require.NoError(t, s.Delete(ctx, "gauge", "TestCounter"))
+	assert.ErrorIs(t, s.Delete(ctx, "gauge", "TestCounter"), ErrNotFound)
+	assert.Equal(t, int64(1), mustCounter(t, s, "TestCounter"), "counter with the same name stays")
+
+	require.NoError(t, s.ResetCounter(ctx, labeled))
+	assert.Equal(t, int64(0), mustCounter(t, s, labeled))
+	samples, err := s.History(ctx, "counter", labeled, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, 0.0, samples[1].Value)
+	assert.ErrorIs(t, s.ResetCounter(ctx, "Alloc"), ErrNotFound)
+
+	n, err := s.DeletePrefix(ctx, "TestC")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	metrics, err := s.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "Alloc", metrics[0].ID)
+	assert.Equal(t, "Test", metrics[1].ID)
+}
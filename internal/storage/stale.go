@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/lionslon/go-yapmetrics/internal/logger"
+	"github.com/lionslon/go-yapmetrics/internal/models"
+	"go.uber.org/zap"
+)
+
+// maxExpireInterval как часто ExpireStale ищет устаревшие серии при большом TTL.
+const maxExpireInterval = time.Minute
+
+// markStale отмечает серии, которые не обновлялись дольше ttl. При ttl <= 0 серии не устаревают.
+func markStale(metrics []models.Metrics, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	for i := range metrics {
+		metrics[i].Stale = now.Sub(metrics[i].UpdatedAt) > ttl
+	}
+}
+
+// ExpireStale удаляет из st серии, которые не обновлялись дольше ttl, пока не отменён ctx.
+// Проверка идёт раз в ttl, но не реже maxExpireInterval. Сообщения пишутся в логгер из ctx.
+func ExpireStale(ctx context.Context, st MetricsStore, ttl time.Duration) {
+	interval := ttl
+	if interval > maxExpireInterval {
+		interval = maxExpireInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := st.PurgeStale(ctx, now.Add(-ttl))
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.FromContext(ctx).Error("expire stale metrics", zap.Error(err))
+				}
+				continue
+			}
+			if n > 0 {
+				logger.FromContext(ctx).Info("expired stale series", zap.Int("series", n))
+			}
+		}
+	}
+}